@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type batchRequest struct {
+	Queries []query `json:"queries"`
+}
+
+// batchResult is the outcome of one query in a batch: its results, or why it failed.
+type batchResult struct {
+	*response
+	Error string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// handleBatch serves batches of queries posted to /v1/complete/batch.
+// Every query that names the same index sees the same snapshot of it, even if it's reloaded meanwhile.
+func (s *indexSet) handleBatch(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if negotiate(r.Header.Get("Accept"), []string{mediaJSON}) == "" {
+		http.Error(w, "results are available as "+mediaJSON, http.StatusNotAcceptable)
+		return
+	}
+
+	var batch batchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&batch)
+	if err == nil && len(batch.Queries) > maxBatch {
+		err = fmt.Errorf("a batch may have at most %d queries", maxBatch)
+	}
+	if err != nil {
+		logger.Debugf("(%s) %d (%s)", r.RemoteAddr, http.StatusBadRequest, err)
+		http.Error(w, fmt.Sprintf("bad batch: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// take each index the batch needs just once, and hold on to it until the batch is done
+	snapshots := map[string]index.Searcher{}
+	resp := batchResponse{Results: make([]batchResult, len(batch.Queries))}
+	var wg sync.WaitGroup
+
+	for i := range batch.Queries {
+
+		q := &batch.Queries[i]
+		if err := q.check(); err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+
+		f := s.Default()
+		if q.Index != "" {
+			var ok bool
+			if f, ok = s.byName[q.Index]; !ok {
+				resp.Results[i].Error = fmt.Sprintf("no index named %s", q.Index)
+				continue
+			}
+		}
+		in, ok := snapshots[f.name]
+		if !ok {
+			in = f.Index()
+			snapshots[f.name] = in
+		}
+
+		wg.Add(1)
+		go func(q *query, in index.Searcher, res *batchResult) {
+			defer wg.Done()
+			res.response = runPooled(q, in)
+		}(q, in, &resp.Results[i])
+
+	}
+
+	wg.Wait()
+	runtime.KeepAlive(snapshots)
+
+	writeJSON(w, r, http.StatusOK, &resp)
+
+}
+
+// runPooled runs q against in once one of the pool's results buffers is free,
+// and returns a copy of the results that outlives the buffer.
+// It returns nil if q is abandoned before a buffer comes free.
+func runPooled(q *query, in searcher) *response {
+
+	waitStart := time.Now()
+	var resultsBuffer *resultsBuffer
+	select {
+	case resultsBuffer = <-pool:
+	case <-q.done:
+		return nil
+	}
+	poolWaitSeconds.observeSince(waitStart)
+	defer func() {
+		pool <- resultsBuffer
+	}()
+	defer runtime.KeepAlive(in)
+
+	resp := q.run(in, resultsBuffer)
+
+	results := make([]result, len(resp.Results))
+	copy(results, resp.Results)
+	for i := range results {
+		// edits point into the buffer's matches, so they need copying too
+		if results[i].Edits != nil {
+			edits := *results[i].Edits
+			results[i].Edits = &edits
+		}
+	}
+	resp.Results = results
+
+	return &resp
+
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	// one query of each kind that fails, among some that don't, which must still be answered in order
+	w := serve(indexes.handleBatch, http.MethodPost, "/v1/complete/batch", `{"queries":[
+		{"prefix":"foo","limit":1},
+		{"prefix":"foo","index":"nope"},
+		{"prefix":"foo","limit":-1}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	resp := struct {
+		Results []struct {
+			Results []result `json:"results"`
+			More    *bool    `json:"more"`
+			Error   string   `json:"error"`
+		} `json:"results"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %s: %s", w.Body, err)
+	}
+	if len(resp.Results) != 3 {
+		t.Fatalf("expected 3 results, got %s", w.Body)
+	}
+
+	first := resp.Results[0]
+	if first.Error != "" || len(first.Results) != 1 || first.Results[0].Name != "foo_bar" || first.More == nil || !*first.More {
+		t.Errorf("expected foo_bar with more to come first, got %s", w.Body)
+	}
+	if res := resp.Results[1]; res.Error != "no index named nope" || res.Results != nil || res.More != nil {
+		t.Errorf("expected only an error for an unknown index, got %+v", res)
+	}
+	if res := resp.Results[2]; !strings.Contains(res.Error, "limit") || res.Results != nil {
+		t.Errorf("expected only an error for a negative limit, got %+v", res)
+	}
+
+	// more queries than the pool has buffers for must all still be answered
+	w = serve(indexes.handleBatch, http.MethodPost, "/v1/complete/batch",
+		`{"queries":[{"prefix":"foo"},{"prefix":"fo","index":"other"},{"prefix":"gUN","options":{"mode":"abbrev"}}]}`)
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"more"`) != 3 {
+		t.Errorf("expected three answers, got %d: %s", w.Code, w.Body)
+	}
+
+}
+
+func TestBatchErrors(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		method string
+		body   string
+		accept string
+		status int
+	}{
+		// maxBatch is 3
+		{http.MethodPost, `{"queries":[{"prefix":"a"},{"prefix":"b"},{"prefix":"c"},{"prefix":"d"}]}`, "", http.StatusBadRequest},
+		{http.MethodPost, `{"queries":[{"prefix":"a"},{"prefix":"b"},{"prefix":"c"}]}`, "", http.StatusOK},
+		{http.MethodPost, `{"queries":[]}`, "", http.StatusOK},
+		{http.MethodPost, `{"queries":[{"prefix":"a","bogus":true}]}`, "", http.StatusBadRequest},
+		{http.MethodPost, `{"query":{"prefix":"a"}}`, "", http.StatusBadRequest},
+		{http.MethodPost, `[`, "", http.StatusBadRequest},
+		{http.MethodPost, `{"queries":[{"prefix":"a"}]}`, "text/plain", http.StatusNotAcceptable},
+		{http.MethodGet, ``, "", http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		if w := serveWith(indexes.handleBatch, c.method, "/v1/complete/batch", c.body, c.accept); w.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", c.method, c.body, c.status, w.Code, w.Body)
+		}
+	}
+
+}
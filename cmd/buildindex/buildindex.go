@@ -1,24 +1,33 @@
 package main
 
 import (
-	"bufio"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	index "github.com/goldibex/prefixserver/index"
+	"io"
 	"os"
 	"path"
-	"strings"
 	"time"
 )
 
+// version identifies this build of buildindex in the headers of the indexes it writes.
+// Release builds set it with -ldflags "-X main.version=...".
+var version = "dev"
+
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [-q] < index_source > binary_index\n\n", path.Base(os.Args[0]))
-		fmt.Fprintf(os.Stderr, "this program reads from stdin and writes to stdout.\n")
-		fmt.Fprintf(os.Stderr, "it expects its input to be a variable-length newline-separated text file in the following format:\n")
-		fmt.Fprintf(os.Stderr, "\n<variable name> <score>\n\n")
-		fmt.Fprintf(os.Stderr, "where <variable name> is a Java variable name and <score> is an integer.\n")
+		fmt.Fprintf(os.Stderr, "usage: %s [-q] [-flat] [-format text|tsv|csv|jsonl] [-on-error fail|skip|warn] [index_source ...] > binary_index\n\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "this program reads the index sources given, or stdin if there are none, and writes to stdout.\n")
+		fmt.Fprintf(os.Stderr, "it expects its input to be a variable-length newline-separated file in one of these formats:\n\n")
+		for _, f := range formats {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", f.name, f.description)
+		}
+		fmt.Fprintf(os.Stderr, "\nwhere <name> is a Java variable name and <score> is an integer.\n")
+		fmt.Fprintf(os.Stderr, "Each name is also indexed under the words within it, as split by the tokenizers given with -tokenizers:\n")
+		fmt.Fprintf(os.Stderr, "underscore (foo_bar), camel (fooBar, HTTPServer), dot (foo.bar), path (foo/bar), kebab (foo-bar) and digit (foo2bar).\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 
 		flag.PrintDefaults()
@@ -28,57 +37,116 @@ func init() {
 func main() {
 
 	quiet := flag.Bool("q", false, "Suppress non-fatal messages")
+	flat := flag.Bool("flat", false, "Write the flat index format, which the server memory-maps instead of decoding")
+	tokenizerNames := flag.String("tokenizers", "underscore", "Comma-separated list of tokenizers for splitting names into words")
+	keyFormName := flag.String("key-form", "", "Comma-separated normalizations for keys, so that queries match regardless of case or Unicode form: nfc or nfkc, and fold-ascii or fold")
+	tieOrderName := flag.String("tie-order", "", "Comma-separated order in which to return results with equal scores: any of value, key (shorter first) and insertion, or none (default value,key,insertion)")
+	format := flag.String("format", "text", "Format of the index source: text, tsv, csv or jsonl")
+	onError := flag.String("on-error", "fail", "What to do with a malformed record: fail, skip it, or warn about it and skip it")
+	maxSkipped := flag.Int("max-skipped", -1, "Fail once more than this many malformed records have been skipped, or -1 for no limit")
+	maxLineLength := flag.Int("max-line-length", 1<<20, "Treat lines longer than this many bytes as malformed")
+	header := flag.Bool("header", true, "Begin the index with a header recording how it was built and a checksum (servers older than the header can't read it)")
 	startTime := time.Now()
 
 	flag.Parse()
+
+	tokenizer, err := index.ParseTokenizers(*tokenizerNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+		os.Exit(2)
+	}
+
+	keyForm, err := index.ParseKeyForm(*keyFormName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+		os.Exit(2)
+	}
+	if keyForm != (index.KeyForm{}) && !*header {
+		// the server learns the key form from the header, and without it would search in the wrong form
+		fmt.Fprintf(os.Stderr, "%s: -key-form needs -header\n", path.Base(os.Args[0]))
+		os.Exit(2)
+	}
+
+	tieOrder, err := index.ParseTieOrder(*tieOrderName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+		os.Exit(2)
+	}
+	if *tieOrderName != "" && !*header {
+		// the server learns the tie order from the header, and without it would use the default
+		fmt.Fprintf(os.Stderr, "%s: -tie-order needs -header\n", path.Base(os.Args[0]))
+		os.Exit(2)
+	}
+
+	if *onError != "fail" && *onError != "skip" && *onError != "warn" {
+		fmt.Fprintf(os.Stderr, "%s: -on-error must be fail, skip or warn\n", path.Base(os.Args[0]))
+		os.Exit(2)
+	}
+
+	sources := flag.Args()
+	if len(sources) == 0 {
+		sources = []string{"-"}
+	}
+
 	stat, _ := os.Stdout.Stat()
 	if (stat.Mode() & os.ModeCharDevice) != 0 {
 		fmt.Fprintf(os.Stderr, "%s: won't write index to a terminal\n", path.Base(os.Args[0]))
 		os.Exit(1)
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	nextWord := ""
-	nextScore := 0
-
 	in := index.New()
 
 	if !*quiet {
 		fmt.Fprintf(os.Stderr, "Now building index. Each . represents 10,000 entries.\n")
 	}
 	entriesAdded := 0
+	// hash every source, as one, for the index header
+	sourceHash := sha256.New()
+	policy := &skipPolicy{onError: *onError, maxSkipped: *maxSkipped, warnings: os.Stderr}
+
+	for _, source := range sources {
 
-	for scanner.Scan() {
-		entriesAdded++
-		if entriesAdded%10000 == 0 && !*quiet {
-			fmt.Fprintf(os.Stderr, ".")
+		name, file := "stdin", os.Stdin
+		if source != "-" {
+			f, err := os.Open(source)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+				os.Exit(1)
+			}
+			name, file = source, f
 		}
-		if count, err := fmt.Sscanf(scanner.Text(), "%s %d", &nextWord, &nextScore); err != nil {
-			fmt.Fprintln(os.Stderr, "reading standard input: ", err)
-			os.Exit(1)
-		} else if count != 2 {
-			fmt.Fprintf(os.Stderr, "Invalid line: '%s'\n", scanner.Text())
-			os.Exit(1)
-		} else {
-			wordAsBytes := []byte(nextWord)
-			in.Add(wordAsBytes, wordAsBytes, nextScore)
-
-			// also add the underscored prefixes
-			part := nextWord
-
-			for {
-				nextPrefixPos := strings.Index(part, "_")
-				if nextPrefixPos == -1 {
-					break
-				}
-				part = part[nextPrefixPos+1:]
-				in.Add([]byte(part), wordAsBytes, nextScore)
+
+		records, err := newRecordReader(*format, name, io.TeeReader(file, sourceHash), *maxLineLength)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+			os.Exit(2)
+		}
+
+		err = policy.readAll(records, func(rec record) {
+			entriesAdded++
+			if entriesAdded%10000 == 0 && !*quiet {
+				fmt.Fprintf(os.Stderr, ".")
 			}
+
+			addRecord(in, tokenizer, keyForm, rec)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\n%s: %s\n", path.Base(os.Args[0]), err)
+			os.Exit(1)
 		}
+
+		file.Close()
+
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "reading standard input: \n", err)
-		os.Exit(1)
+
+	if policy.skipped > 0 && !*quiet {
+		fmt.Fprintf(os.Stderr, "\nSkipped %d malformed records and indexed %d:\n", policy.skipped, entriesAdded)
+		for _, msg := range policy.errors {
+			fmt.Fprintf(os.Stderr, "  %s\n", msg)
+		}
+		if policy.skipped > len(policy.errors) {
+			fmt.Fprintf(os.Stderr, "  ... and %d more\n", policy.skipped-len(policy.errors))
+		}
 	}
 
 	if !*quiet {
@@ -90,13 +158,113 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Encoding index...\n")
 	}
 
-	enc := gob.NewEncoder(os.Stdout)
-	if err := enc.Encode(in); err != nil {
-		fmt.Fprintln(os.Stderr, "gob encoding index: ", err)
-		os.Exit(1)
+	if *header {
+		h := index.Header{
+			Builder:      "buildindex " + version,
+			BuiltAt:      time.Now().UTC(),
+			SourceSHA256: hex.EncodeToString(sourceHash.Sum(nil)),
+			SourceFormat: *format,
+			Tokenizers:   *tokenizerNames,
+			KeyForm:      keyForm.String(),
+			Entries:      in.Entries(),
+		}
+		if *tieOrderName != "" {
+			h.TieOrder = tieOrder.String()
+		}
+		if err := in.WriteWithHeader(os.Stdout, h, *flat); err != nil {
+			fmt.Fprintln(os.Stderr, "writing index:", err)
+			os.Exit(1)
+		}
+	} else if *flat {
+		if err := in.WriteFlat(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "writing flat index: ", err)
+			os.Exit(1)
+		}
+	} else {
+		enc := gob.NewEncoder(os.Stdout)
+		if err := enc.Encode(in); err != nil {
+			fmt.Fprintln(os.Stderr, "gob encoding index: ", err)
+			os.Exit(1)
+		}
 	}
 	if !*quiet {
 		fmt.Fprintf(os.Stderr, "Finished in %2f s\n", time.Since(startTime).Seconds())
 	}
 
 }
+
+// skipPolicy says what to do with malformed records, and counts those skipped.
+type skipPolicy struct {
+	// onError is fail, skip, or warn, which also reports each record skipped to warnings
+	onError  string
+	warnings io.Writer
+	// maxSkipped is the most records that may be skipped before giving up, or -1 for no limit
+	maxSkipped int
+
+	skipped int
+	// errors holds the first few errors skipped, for the summary
+	errors []string
+}
+
+// readAll passes every record records reads to add, skipping malformed ones if p allows.
+// It returns the error that stopped it, if it didn't reach the end of the records.
+func (p *skipPolicy) readAll(records recordReader, add func(rec record)) error {
+
+	for {
+
+		rec, err := records.Read()
+		if err == io.EOF {
+			return nil
+		} else if srcErr, ok := err.(*sourceError); ok && p.onError != "fail" {
+			p.skipped++
+			if len(p.errors) < 10 {
+				p.errors = append(p.errors, srcErr.Error())
+			}
+			if p.onError == "warn" {
+				fmt.Fprintf(p.warnings, "skipping %s\n", srcErr)
+			}
+			if p.maxSkipped >= 0 && p.skipped > p.maxSkipped {
+				return fmt.Errorf("giving up after skipping more than %d malformed records", p.maxSkipped)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		add(rec)
+
+	}
+
+}
+
+// addRecord adds rec to the index under its name, and under the keys tokenizer
+// finds within the name and any extra keys the source gave for it, each put into form.
+func addRecord(in *index.Index, tokenizer index.Tokenizer, form index.KeyForm, rec record) {
+
+	var payload []byte
+	if rec.Payload != nil {
+		// the only error is for a negative line, which the reader has already ruled out
+		payload, _ = rec.Payload.MarshalBinary()
+	}
+
+	wordAsBytes := []byte(rec.Name)
+
+	// tokenize the name as given, since tokenizers like camel can depend on its case
+	keys := append([][]byte{wordAsBytes}, tokenizer.Keys(wordAsBytes)...)
+	for _, key := range rec.Keys {
+		keys = append(keys, []byte(key))
+	}
+
+	// add the name once, under every key, so that searches reaching it through several keys return it once
+	added := map[string]bool{}
+	entryKeys := [][]byte{}
+	for _, key := range keys {
+		key = form.Key(key)
+		if !added[string(key)] {
+			added[string(key)] = true
+			entryKeys = append(entryKeys, key)
+		}
+	}
+	in.AddEntry(entryKeys, wordAsBytes, payload, rec.Score)
+
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// record is a single entry read from an index source.
+type record struct {
+	Name  string   `json:"name"`
+	Score int      `json:"score"`
+	Keys  []string `json:"keys"`
+	// Payload is stored in the index alongside the name, and handed back with it by searches
+	Payload *index.Payload `json:"payload"`
+}
+
+// recordReader reads the records of an index source one at a time.
+type recordReader interface {
+	// Read returns the next record, or io.EOF once there are none left.
+	Read() (record, error)
+}
+
+// formats lists the index source formats, and describes each one for the usage message.
+var formats = []struct {
+	name, description string
+}{
+	{"text", "<name> <score> on each line, with any further fields ignored. A name may contain spaces if its score is the last field."},
+	{"tsv", "<name>\\t<score>[\\t<key>...] on each line, with any further fields taken as extra keys for the name."},
+	{"csv", "name,score[,key...] as RFC 4180 CSV, with any further fields taken as extra keys. A name,score header row is skipped."},
+	{"jsonl", `one JSON object per line, as in {"name": "fooBar", "score": 10, "keys": ["bar"], "payload": {"type": "int", "class": "Foo", "file": "Foo.java", "line": 12, "doc_url": "..."}}. keys, payload and each field of the payload are optional. Other fields of the payload are kept as they are; any other field of the record is an error.`},
+}
+
+// sourceError is an error in a single record of an index source, which can be skipped over.
+// Any other error from a recordReader means the source can't be read any further.
+type sourceError struct {
+	name string
+	line int
+	err  error
+}
+
+func (e *sourceError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.name, e.line, e.err)
+}
+
+// newRecordReader returns a reader for the index source r, which is in the given format.
+// name identifies the source in errors. Lines, or CSV records, longer than maxLen bytes are rejected.
+func newRecordReader(format string, name string, r io.Reader, maxLen int) (recordReader, error) {
+	switch format {
+	case "text":
+		return newLineReader(name, r, maxLen, parseText), nil
+	case "tsv":
+		return newLineReader(name, r, maxLen, parseTSV), nil
+	case "jsonl":
+		return newLineReader(name, r, maxLen, parseJSONL), nil
+	case "csv":
+		c := csv.NewReader(r)
+		c.FieldsPerRecord = -1
+		return &csvReader{name: name, reader: c, maxLen: maxLen}, nil
+	}
+	return nil, fmt.Errorf("unknown input format %q", format)
+}
+
+// lineReader reads formats with one record per line, skipping blank lines.
+type lineReader struct {
+	name   string
+	reader *bufio.Reader
+	maxLen int
+	line   int
+	parse  func(line string) (record, error)
+}
+
+func newLineReader(name string, r io.Reader, maxLen int, parse func(line string) (record, error)) *lineReader {
+	return &lineReader{name: name, reader: bufio.NewReader(r), maxLen: maxLen, parse: parse}
+}
+
+// readLine returns the next line without its line ending. A line longer than maxLen
+// is read to its end but not kept, and reported by tooLong instead.
+func (l *lineReader) readLine() (line []byte, tooLong bool, err error) {
+
+	read := 0
+
+	for {
+
+		chunk, err := l.reader.ReadSlice('\n')
+		read += len(chunk)
+
+		if !tooLong {
+			line = append(line, chunk...)
+			// allow for a \r\n line ending, which is trimmed below
+			if len(line) > l.maxLen+2 {
+				line, tooLong = nil, true
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && read > 0 {
+			// the last line has no line ending
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		break
+
+	}
+
+	l.line++
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	if len(line) > l.maxLen {
+		return nil, true, nil
+	}
+
+	return line, tooLong, nil
+
+}
+
+func (l *lineReader) Read() (record, error) {
+
+	for {
+
+		line, tooLong, err := l.readLine()
+		if err != nil {
+			return record{}, err
+		}
+
+		if tooLong {
+			return record{}, &sourceError{l.name, l.line, fmt.Errorf("line longer than %d bytes", l.maxLen)}
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		rec, err := l.parse(string(line))
+		if err != nil {
+			return rec, &sourceError{l.name, l.line, err}
+		}
+
+		return rec, nil
+
+	}
+
+}
+
+// parseText reads a line of the text format. A name followed by a score is read as earlier versions read it,
+// ignoring any fields after the score; otherwise the score is taken to be the last field, and the name everything before it.
+func parseText(line string) (record, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) >= 2 {
+		if score, err := strconv.Atoi(fields[1]); err == nil {
+			return record{Name: fields[0], Score: score}, nil
+		}
+	}
+
+	line = strings.TrimSpace(line)
+	split := strings.LastIndexAny(line, " \t")
+	if split == -1 {
+		return record{}, errors.New("expected <name> <score>")
+	}
+
+	score, err := strconv.Atoi(line[split+1:])
+	if err != nil {
+		return record{}, fmt.Errorf("bad score: %s", err)
+	}
+
+	return record{Name: strings.TrimSpace(line[:split]), Score: score}, nil
+
+}
+
+func parseTSV(line string) (record, error) {
+	return parseFields(strings.Split(line, "\t"))
+}
+
+// parseFields reads a record from the fields of a row of TSV or CSV.
+func parseFields(fields []string) (record, error) {
+
+	if len(fields) < 2 {
+		return record{}, errors.New("expected at least a name and a score")
+	}
+
+	score, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return record{}, fmt.Errorf("bad score: %s", err)
+	}
+
+	rec := record{Name: fields[0], Score: score}
+	for _, key := range fields[2:] {
+		if key != "" {
+			rec.Keys = append(rec.Keys, key)
+		}
+	}
+
+	if rec.Name == "" {
+		return record{}, errors.New("empty name")
+	}
+
+	return rec, nil
+
+}
+
+func parseJSONL(line string) (record, error) {
+
+	var rec record
+	// a field of the record the index has no place for is an error rather than being dropped, since it's more likely
+	// a mistake than something the source meant to lose; the payload keeps fields it doesn't know in its Extra
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rec); err != nil {
+		return record{}, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return record{}, errors.New("unexpected data after the record")
+	}
+
+	if rec.Name == "" {
+		return record{}, errors.New("missing name")
+	}
+
+	if rec.Payload != nil && rec.Payload.Line < 0 {
+		return record{}, errors.New("negative line in payload")
+	}
+
+	return rec, nil
+
+}
+
+// csvReader reads CSV, in which a record may span several lines.
+type csvReader struct {
+	name   string
+	reader *csv.Reader
+	maxLen int
+	rows   int
+}
+
+func (c *csvReader) Read() (record, error) {
+
+	for {
+
+		fields, err := c.reader.Read()
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return record{}, &sourceError{c.name, parseErr.Line, parseErr.Err}
+		} else if err != nil {
+			return record{}, err
+		}
+		c.rows++
+		line, _ := c.reader.FieldPos(0)
+
+		length := 0
+		for _, field := range fields {
+			length += len(field)
+		}
+		if length > c.maxLen {
+			return record{}, &sourceError{c.name, line, fmt.Errorf("record longer than %d bytes", c.maxLen)}
+		}
+
+		if c.rows == 1 && len(fields) >= 2 && fields[0] == "name" && fields[1] == "score" {
+			// skip the header row
+			continue
+		}
+
+		rec, err := parseFields(fields)
+		if err != nil {
+			return rec, &sourceError{c.name, line, err}
+		}
+
+		return rec, nil
+
+	}
+
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONL(t *testing.T) {
+
+	cases := []struct {
+		line string
+		rec  record
+		err  bool
+	}{
+		{`{"name": "fooBar", "score": 10}`, record{Name: "fooBar", Score: 10}, false},
+		{`{"name": "fooBar", "score": 10, "keys": ["bar"]}`, record{Name: "fooBar", Score: 10, Keys: []string{"bar"}}, false},
+		{`{"name": "fooBar", "score": 10, "payload": {"type": "int", "class": "Foo", "file": "Foo.java", "line": 12, "doc_url": "u"}}`,
+			record{Name: "fooBar", Score: 10, Payload: &index.Payload{Type: "int", Class: "Foo", File: "Foo.java", Line: 12, DocURL: "u"}}, false},
+		{`  {"name": "fooBar", "score": 10}  `, record{Name: "fooBar", Score: 10}, false},
+		// the payload keeps fields it doesn't know, but fields the record has no place for are errors rather than being dropped
+		{`{"name": "fooBar", "score": 10, "payload": {"type": "int", "kind": "field", "tags": [1, 2]}}`,
+			record{Name: "fooBar", Score: 10, Payload: &index.Payload{Type: "int", Extra: map[string]json.RawMessage{"kind": json.RawMessage(`"field"`), "tags": json.RawMessage(`[1, 2]`)}}}, false},
+		{`{"name": "fooBar", "score": 10, "payload": {"type": 1}}`, record{}, true},
+		{`{"name": "fooBar", "score": 10, "paylaod": {"type": "int"}}`, record{}, true},
+		{`{"name": "fooBar", "score": 10} {"name": "baz", "score": 1}`, record{}, true},
+		{`{"name": "fooBar", "score": 10}}`, record{}, true},
+		{`{"score": 10}`, record{}, true},
+		{`{"name": "fooBar", "score": "ten"}`, record{}, true},
+		{`{"name": "fooBar", "score": 10, "payload": {"line": -1}}`, record{}, true},
+	}
+
+	for _, c := range cases {
+		rec, err := parseJSONL(c.line)
+		if (err != nil) != c.err {
+			t.Errorf("%s: expected error: %v, got %v", c.line, c.err, err)
+			continue
+		}
+		if !c.err && !reflect.DeepEqual(rec, c.rec) {
+			t.Errorf("%s: expected %+v, got %+v", c.line, c.rec, rec)
+		}
+	}
+
+}
+
+// readRecords reads the index source input in format until it ends, describing each record it reads,
+// or the sourceError in its place, as a string.
+func readRecords(t *testing.T, format string, input string, maxLen int) []string {
+
+	records, err := newRecordReader(format, "src", strings.NewReader(input), maxLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := []string{}
+	for {
+		rec, err := records.Read()
+		if err == io.EOF {
+			return read
+		} else if srcErr, ok := err.(*sourceError); ok {
+			read = append(read, srcErr.Error())
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error %s", format, err)
+		} else {
+			read = append(read, fmt.Sprintf("%q %d %q", rec.Name, rec.Score, rec.Keys))
+		}
+	}
+
+}
+
+func TestRecordReaders(t *testing.T) {
+
+	cases := []struct {
+		format string
+		input  string
+		maxLen int
+		// expected describes each record as readRecords does; errors need only match the start of the message
+		expected []string
+	}{
+		{"text", "foo 10\n\nbar baz\t5\r\nnoscore\nqux x\n  padded  -3  \nlast 1", 100, []string{
+			`"foo" 10 []`,
+			`"bar baz" 5 []`,
+			"src:4: expected <name> <score>",
+			"src:5: bad score",
+			`"padded" -3 []`,
+			`"last" 1 []`,
+		}},
+		// fields after the score are ignored, as they always have been
+		{"text", "foo 10 extra\nbar 5 6\nNew York 10 x\n", 100, []string{
+			`"foo" 10 []`,
+			`"bar" 5 []`,
+			"src:3: bad score",
+		}},
+		{"text", "short 1\nmuch_too_long 1\nshort 2\n", 10, []string{
+			`"short" 1 []`,
+			"src:2: line longer than 10 bytes",
+			`"short" 2 []`,
+		}},
+		{"tsv", "foo bar\t10\tfb\t\tb\nbar\nbaz\tx\n\t3\n\nlast\t 1 \n", 100, []string{
+			`"foo bar" 10 ["fb" "b"]`,
+			"src:2: expected at least a name and a score",
+			"src:3: bad score",
+			"src:4: empty name",
+			`"last" 1 []`,
+		}},
+		{"csv", "name,score\n\"foo,bar\",10,fb,,b\n\"two\nlines\",5\nbad\nx,1\n\"unterminated,3\n", 100, []string{
+			`"foo,bar" 10 ["fb" "b"]`,
+			`"two\nlines" 5 []`,
+			"src:5: expected at least a name and a score",
+			`"x" 1 []`,
+			"src:7: extraneous or missing \" in quoted-field",
+		}},
+		{"csv", "foo,1\nname,score\n", 100, []string{
+			`"foo" 1 []`,
+			// only a first row can be a header
+			"src:2: bad score",
+		}},
+		{"csv", "short,1\nmuch_too_long,1\nshort,2\n", 10, []string{
+			`"short" 1 []`,
+			"src:2: record longer than 10 bytes",
+			`"short" 2 []`,
+		}},
+		{"jsonl", `{"name": "a", "score": 1, "keys": ["x"]}` + "\nnot json\n\n" + `{"name": "b", "score": 2, "kind": 1}` + "\n" + `{"name": "c", "score": 3}`, 100, []string{
+			`"a" 1 ["x"]`,
+			"src:2: invalid character",
+			`src:4: json: unknown field "kind"`,
+			`"c" 3 []`,
+		}},
+	}
+
+	for _, c := range cases {
+
+		read := readRecords(t, c.format, c.input, c.maxLen)
+		if len(read) != len(c.expected) {
+			t.Errorf("%s %q: expected %d records, got %d: %q", c.format, c.input, len(c.expected), len(read), read)
+			continue
+		}
+
+		for i := range read {
+			if strings.HasPrefix(c.expected[i], "src:") && strings.HasPrefix(read[i], c.expected[i]) {
+				continue
+			}
+			if read[i] != c.expected[i] {
+				t.Errorf("%s %q: expected record %d to be %s, got %s", c.format, c.input, i, c.expected[i], read[i])
+			}
+		}
+
+	}
+
+	if _, err := newRecordReader("xml", "src", strings.NewReader(""), 100); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+
+}
+
+func TestReadLine(t *testing.T) {
+
+	long := strings.Repeat("x", 10000)
+	// tooLong stands for a line that's too long to keep
+	const tooLong = "(too long)"
+
+	cases := []struct {
+		input  string
+		maxLen int
+		lines  []string
+	}{
+		{"12345\n123456\n12345\r\n123456\r\n", 5, []string{"12345", tooLong, "12345", tooLong}},
+		// lines longer than the reader's buffer are still read whole, or skipped whole if they're too long
+		{long + "\nok\n" + long, 9999, []string{tooLong, "ok", tooLong}},
+		{long + "\r\nok\n", 10000, []string{long, "ok"}},
+		// the last line needn't end with a newline
+		{"a\nb", 5, []string{"a", "b"}},
+		{"a\n\n", 5, []string{"a", ""}},
+		{"", 5, []string{}},
+	}
+
+	for _, c := range cases {
+
+		l := newLineReader("src", strings.NewReader(c.input), c.maxLen, parseText)
+
+		for i, expected := range c.lines {
+			line, isTooLong, err := l.readLine()
+			if err != nil {
+				t.Fatalf("%.20q: line %d: unexpected error %s", c.input, i+1, err)
+			}
+			if isTooLong {
+				if line != nil {
+					t.Errorf("%.20q: line %d: expected a line that's too long not to be kept, got %.20q", c.input, i+1, line)
+				}
+				line = []byte(tooLong)
+			}
+			if string(line) != expected {
+				t.Errorf("%.20q: line %d: expected %.20q, got %.20q", c.input, i+1, expected, line)
+			}
+			if l.line != i+1 {
+				t.Errorf("%.20q: expected to be at line %d, got %d", c.input, i+1, l.line)
+			}
+		}
+
+		if _, _, err := l.readLine(); err != io.EOF {
+			t.Errorf("%.20q: expected io.EOF after %d lines, got %v", c.input, len(c.lines), err)
+		}
+
+	}
+
+}
+
+// scriptedReader returns each of its records, or the error in its place, in turn.
+type scriptedReader struct {
+	records []record
+	errs    []error
+}
+
+func (s *scriptedReader) Read() (record, error) {
+	if len(s.records) == 0 {
+		return record{}, io.EOF
+	}
+	rec, err := s.records[0], s.errs[0]
+	s.records, s.errs = s.records[1:], s.errs[1:]
+	return rec, err
+}
+
+func TestSkipPolicy(t *testing.T) {
+
+	bad := &sourceError{"src", 2, errors.New("bad score")}
+	worse := &sourceError{"src", 4, errors.New("empty name")}
+	broken := errors.New("read failed")
+
+	cases := []struct {
+		onError    string
+		maxSkipped int
+		errs       []error
+		added      int
+		skipped    int
+		err        string
+		warnings   string
+	}{
+		{"fail", -1, []error{nil, bad, nil}, 1, 0, "src:2: bad score", ""},
+		{"skip", -1, []error{nil, bad, nil, worse}, 2, 2, "", ""},
+		{"warn", -1, []error{nil, bad, nil, worse}, 2, 2, "", "skipping src:2: bad score\nskipping src:4: empty name\n"},
+		{"skip", 2, []error{bad, worse, nil}, 1, 2, "", ""},
+		{"skip", 1, []error{bad, worse, nil}, 0, 2, "giving up after skipping more than 1 malformed records", ""},
+		{"skip", 0, []error{nil, bad}, 1, 1, "giving up after skipping more than 0 malformed records", ""},
+		// errors reading the source itself are never skipped
+		{"skip", -1, []error{nil, broken, nil}, 1, 0, "read failed", ""},
+	}
+
+	for _, c := range cases {
+
+		warnings := bytes.Buffer{}
+		p := &skipPolicy{onError: c.onError, maxSkipped: c.maxSkipped, warnings: &warnings}
+		records := &scriptedReader{records: make([]record, len(c.errs)), errs: c.errs}
+
+		added := 0
+		err := p.readAll(records, func(rec record) { added++ })
+
+		if (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("%s, max %d, %v: expected error %q, got %v", c.onError, c.maxSkipped, c.errs, c.err, err)
+		}
+		if added != c.added || p.skipped != c.skipped {
+			t.Errorf("%s, max %d, %v: expected %d added and %d skipped, got %d and %d", c.onError, c.maxSkipped, c.errs, c.added, c.skipped, added, p.skipped)
+		}
+		if len(p.errors) != p.skipped {
+			t.Errorf("%s, max %d, %v: expected the errors skipped to be kept, got %q", c.onError, c.maxSkipped, c.errs, p.errors)
+		}
+		if warnings.String() != c.warnings {
+			t.Errorf("%s, max %d, %v: expected warnings %q, got %q", c.onError, c.maxSkipped, c.errs, c.warnings, warnings.String())
+		}
+
+	}
+
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
 	"flag"
 	"fmt"
 	index "github.com/goldibex/prefixserver/index"
 	"os"
 	"path"
+	"time"
 )
 
 func init() {
@@ -25,16 +25,38 @@ func main() {
 		os.Exit(2)
 	}
 
-	in := index.Index{}
-	reader, err := os.Open(flag.Arg(0))
+	// unlike the server, which by default checks only as much as it needs to to load an index, check all of it
+	err := index.Verify(flag.Arg(0))
+	var in index.Searcher
+	var header *index.Header
+	if err == nil {
+		in, header, err = index.Load(flag.Arg(0))
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "reading %s: %s\n", flag.Arg(0), err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+		// exit as the server does, with 3 for a file that can't be read and 4 for one that isn't an index
+		if _, ok := err.(*index.FormatError); ok {
+			os.Exit(4)
+		}
+		os.Exit(3)
 	}
-	dec := gob.NewDecoder(reader)
-	if err = dec.Decode(&in); err != nil {
-		fmt.Fprintf(os.Stderr, "opening %s: %s\n", flag.Arg(0), err)
-		os.Exit(1)
+
+	if header != nil {
+		fmt.Printf("format:      %s (header version %d)\n", header.Format, header.Version)
+		fmt.Printf("built by:    %s\n", header.Builder)
+		fmt.Printf("built at:    %s\n", header.BuiltAt.Format(time.RFC3339))
+		fmt.Printf("source:      %s, SHA-256 %s\n", header.SourceFormat, header.SourceSHA256)
+		fmt.Printf("tokenizers:  %s\n", header.Tokenizers)
+		if header.KeyForm != "" {
+			fmt.Printf("key form:    %s\n", header.KeyForm)
+		}
+		if header.TieOrder != "" {
+			fmt.Printf("tie order:   %s\n", header.TieOrder)
+		}
+		fmt.Printf("entries:     %d\n", header.Entries)
+		fmt.Printf("body:        %d bytes, CRC-32C %08x\n", header.BodyLength, header.BodyCRC32C)
+	} else {
+		fmt.Printf("no header; entries: %d, keys: %d\n", in.Entries(), in.Keys())
 	}
 
 	inReader := bufio.NewReader(os.Stdin)
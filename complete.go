@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxQueryBody is the largest JSON body a query may be posted with.
+const maxQueryBody = 1 << 20
+
+// query is a single completion request, as posted to /v1/complete or built from a URL's parameters.
+type query struct {
+	Prefix string `json:"prefix"`
+	// Index names the index to query, which is the default one if it's empty
+	Index string `json:"index,omitempty"`
+	// Limit is the number of results wanted, which is -limit if it's 0
+	Limit   int          `json:"limit,omitempty"`
+	Offset  int          `json:"offset,omitempty"`
+	Filters queryFilters `json:"filters"`
+	Options queryOptions `json:"options"`
+	// legacy is set for queries to the legacy /{prefix} route, which are answered in its shape
+	legacy bool
+	// done, if set, is closed once the query's answer is no longer wanted, abandoning it
+	done <-chan struct{}
+}
+
+// queryFilters restricts results to those whose payloads and scores match.
+type queryFilters struct {
+	Type     string `json:"type,omitempty"`
+	Class    string `json:"class,omitempty"`
+	MinScore *int   `json:"min_score,omitempty"`
+}
+
+type queryOptions struct {
+	// Fuzzy gives the number of edits allowed, with 0 meaning an exact prefix match
+	Fuzzy int `json:"fuzzy,omitempty"`
+	// Mode is how the prefix is matched: prefix, the default, or abbrev, which matches names it abbreviates
+	Mode string `json:"mode,omitempty"`
+	// Highlight asks for the parts of each result's name that matched, which take some work to find
+	Highlight bool `json:"highlight,omitempty"`
+}
+
+// Query modes.
+const (
+	modePrefix = "prefix"
+	modeAbbrev = "abbrev"
+)
+
+// handleComplete serves queries at /v1/complete, given either by URL parameters or as a JSON body.
+func (s *indexSet) handleComplete(w http.ResponseWriter, r *http.Request) {
+
+	q := &query{}
+	var err error
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		params := r.URL.Query()
+		if _, ok := params["q"]; !ok {
+			err = errors.New("q must be given")
+			break
+		}
+		q.Prefix = params.Get("q")
+		q.Index = params.Get("index")
+		err = q.parseParams(r)
+	case http.MethodPost:
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBody))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(q); err != nil {
+			err = fmt.Errorf("bad query: %s", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == nil {
+		err = q.check()
+	}
+	if err != nil {
+		logger.Debugf("(%s) %d (%s)", r.RemoteAddr, http.StatusBadRequest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f := s.Default()
+	if q.Index != "" {
+		var ok bool
+		if f, ok = s.byName[q.Index]; !ok {
+			http.Error(w, fmt.Sprintf("no index named %s", q.Index), http.StatusNotFound)
+			return
+		}
+	}
+
+	serveQuery(w, r, f, q)
+
+}
+
+// parseParams fills in q from the parameters of r's URL, other than the prefix and index.
+func (q *query) parseParams(r *http.Request) error {
+
+	var err error
+	params := r.URL.Query()
+
+	if q.Limit, err = intParam(r, "limit", 0, 1); err != nil {
+		return err
+	}
+	if q.Offset, err = intParam(r, "offset", 0, 0); err != nil {
+		return err
+	}
+	if q.Options.Fuzzy, err = intParam(r, "fuzzy", 0, 0); err != nil {
+		return err
+	}
+	q.Options.Mode = params.Get("mode")
+	if param := params.Get("highlight"); param != "" {
+		if q.Options.Highlight, err = strconv.ParseBool(param); err != nil {
+			return errors.New("highlight must be true or false")
+		}
+	}
+
+	q.Filters.Type = params.Get("type")
+	q.Filters.Class = params.Get("class")
+	if param := params.Get("min_score"); param != "" {
+		minScore, err := strconv.Atoi(param)
+		if err != nil {
+			return errors.New("min_score must be an integer")
+		}
+		q.Filters.MinScore = &minScore
+	}
+
+	return nil
+
+}
+
+// check makes sure q is sensible, and brings its limit and fuzziness within the server's bounds.
+func (q *query) check() error {
+
+	if q.Limit < 0 {
+		return errors.New("limit must not be negative")
+	}
+	if q.Offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	if q.Offset > maxOffset {
+		// every result before the offset has to be found to be skipped, so deep pages are expensive
+		return fmt.Errorf("offset must be no greater than %d", maxOffset)
+	}
+	if q.Options.Fuzzy < 0 {
+		return errors.New("fuzzy must not be negative")
+	}
+	switch q.Options.Mode {
+	case "", modePrefix:
+	case modeAbbrev:
+		if q.Options.Fuzzy > 0 {
+			return errors.New("fuzzy can't be used with mode abbrev")
+		}
+	default:
+		return fmt.Errorf("mode must be %s or %s", modePrefix, modeAbbrev)
+	}
+
+	if q.Limit == 0 {
+		q.Limit = defaultLimit
+	}
+	if q.Limit > maxLimit {
+		q.Limit = maxLimit
+	}
+	if q.Options.Fuzzy > maxEdits {
+		q.Options.Fuzzy = maxEdits
+	}
+
+	return nil
+
+}
+
+// filter returns a function that reports whether a match passes q's filters, or nil if q has none.
+func (q *query) filter() func(m *index.Match) bool {
+
+	filters := q.Filters
+	if filters.Type == "" && filters.Class == "" && filters.MinScore == nil {
+		return nil
+	}
+
+	return func(m *index.Match) bool {
+
+		if filters.MinScore != nil && m.Score < *filters.MinScore {
+			return false
+		}
+		if filters.Type == "" && filters.Class == "" {
+			return true
+		}
+
+		data, err := m.Data()
+		if err != nil || data == nil {
+			return false
+		}
+		return (filters.Type == "" || data.Type == filters.Type) && (filters.Class == "" || data.Class == filters.Class)
+
+	}
+
+}
+
+// searcher is what a query runs against: an index, or a cursor into one.
+type searcher interface {
+	Search(q *index.Query, offset int, matches []index.Match) int
+}
+
+// run searches in for q, and fills in the results in buf. q must have been checked.
+func (q *query) run(in searcher, buf *resultsBuffer) response {
+
+	search := index.Query{
+		Prefix:    []byte(q.Prefix),
+		CaseBoost: caseBoost,
+		Filter:    q.filter(),
+		// the legacy route has nowhere to put highlights
+		Highlight: q.Options.Highlight && !q.legacy,
+		Done:      q.done,
+	}
+	if q.Options.Fuzzy > 0 {
+		search.MaxEdits = q.Options.Fuzzy
+		search.Penalty = editPenalty
+	}
+	if q.Options.Mode == modeAbbrev {
+		search.Abbrev = true
+		search.Penalty = jumpPenalty
+	}
+
+	// ask for one more result than the limit, so we know whether there are any more after this page
+	matches := buf.matches[0 : q.Limit+1]
+	findStart := time.Now()
+	count := in.Search(&search, q.Offset, matches)
+	findSeconds.observeSince(findStart)
+
+	resp := response{More: count > q.Limit}
+	if resp.More {
+		count = q.Limit
+	}
+	resultCount.observe(float64(count))
+
+	for i := 0; i < count; i++ {
+		buf.results[i] = result{
+			Name:  string(matches[i].Value),
+			Score: matches[i].Score,
+			Key:   string(matches[i].Key),
+		}
+		buf.results[i].Matches = nil
+		for _, span := range matches[i].Spans {
+			buf.results[i].Matches = append(buf.results[i].Matches, highlight{Start: span.RuneOffset, End: span.RuneOffset + span.RuneLength})
+		}
+		if q.Options.Fuzzy > 0 {
+			buf.results[i].Edits = &matches[i].Edits
+		}
+		// decoding copies the payload, which may point into a memory-mapped index
+		data, err := matches[i].Data()
+		if err != nil {
+			logger.Warnf("Bad payload for %s: %s", matches[i].Value, err)
+		}
+		buf.results[i].Data = data
+	}
+	resp.Results = buf.results[0:count]
+
+	return resp
+
+}
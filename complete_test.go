@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	index "github.com/goldibex/prefixserver/index"
+	"net/http"
+	"testing"
+)
+
+func TestCompleteParamsAndBody(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	// each query given as URL parameters should get just the same answer as when posted as JSON
+	cases := []struct {
+		params   string
+		body     string
+		expected []string
+	}{
+		{"q=foo&limit=2&offset=1", `{"prefix":"foo","limit":2,"offset":1}`, []string{"foo_baz", "foo_qux"}},
+		{"q=foo&type=function", `{"prefix":"foo","filters":{"type":"function"}}`, []string{"foo_bar"}},
+		{"q=foo&class=Foo&min_score=6", `{"prefix":"foo","filters":{"class":"Foo","min_score":6}}`, []string{"foo_bar"}},
+		{"q=foo&min_score=3", `{"prefix":"foo","filters":{"min_score":3}}`, []string{"foo_bar", "foo_baz", "foo_qux"}},
+		{"q=fo_bar&fuzzy=1", `{"prefix":"fo_bar","options":{"fuzzy":1}}`, []string{"foo_bar"}},
+		{"q=gUN&mode=abbrev", `{"prefix":"gUN","options":{"mode":"abbrev"}}`, []string{"getUserName"}},
+		{"q=foo&index=other&limit=1", `{"prefix":"foo","index":"other","limit":1}`, []string{"foo_bar"}},
+		{"q=nothing", `{"prefix":"nothing"}`, []string{}},
+	}
+
+	for _, c := range cases {
+
+		get := serve(indexes.handleComplete, http.MethodGet, "/v1/complete?"+c.params, "")
+		post := serve(indexes.handleComplete, http.MethodPost, "/v1/complete", c.body)
+
+		if get.Code != post.Code || get.Body.String() != post.Body.String() {
+			t.Errorf("%s: expected the same answer as %s, got %d %s and %d %s", c.params, c.body, get.Code, get.Body, post.Code, post.Body)
+		}
+
+		resp := response{}
+		if err := json.Unmarshal(get.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: decoding %s: %s", c.params, get.Body, err)
+		}
+		names := []string{}
+		for _, res := range resp.Results {
+			names = append(names, res.Name)
+		}
+		if len(names) != len(c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.params, c.expected, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != c.expected[i] {
+				t.Errorf("%s: expected %v, got %v", c.params, c.expected, names)
+				break
+			}
+		}
+
+	}
+
+}
+
+func TestCompleteErrors(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/v1/complete", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&limit=x", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&limit=0", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&offset=-1", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&min_score=x", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&mode=fuzzy", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&highlight=maybe", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&mode=abbrev&fuzzy=1", "", http.StatusBadRequest},
+		{http.MethodGet, "/v1/complete?q=foo&index=nope", "", http.StatusNotFound},
+		{http.MethodPost, "/v1/complete", `{"prefix":"foo","bogus":1}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/complete", `{"prefix":"foo","limit":-1}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/complete", `{"prefix":"foo","options":{"fuzzy":-1}}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/complete", `{"prefix":"foo","options":{"fuzzy":1,"mode":"abbrev"}}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/complete", `prefix=foo`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/complete", `{"prefix":"foo","index":"nope"}`, http.StatusNotFound},
+		{http.MethodPut, "/v1/complete", `{"prefix":"foo"}`, http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		if w := serve(indexes.handleComplete, c.method, c.target, c.body); w.Code != c.status {
+			t.Errorf("%s %s %s: expected status %d, got %d: %s", c.method, c.target, c.body, c.status, w.Code, w.Body)
+		}
+	}
+
+}
+
+func TestQueryCheck(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		q        query
+		expected query
+		err      bool
+	}{
+		{query{}, query{Limit: defaultLimit}, false},
+		{query{Limit: 5, Offset: 7}, query{Limit: 5, Offset: 7}, false},
+		{query{Limit: maxLimit + 1}, query{Limit: maxLimit}, false},
+		{query{Options: queryOptions{Fuzzy: maxEdits + 1}}, query{Limit: defaultLimit, Options: queryOptions{Fuzzy: maxEdits}}, false},
+		{query{Options: queryOptions{Mode: modePrefix}}, query{Limit: defaultLimit, Options: queryOptions{Mode: modePrefix}}, false},
+		{query{Limit: -1}, query{}, true},
+		{query{Offset: -1}, query{}, true},
+		{query{Offset: maxOffset + 1}, query{}, true},
+		{query{Options: queryOptions{Fuzzy: -1}}, query{}, true},
+		{query{Options: queryOptions{Mode: "regexp"}}, query{}, true},
+	}
+
+	for _, c := range cases {
+		q := c.q
+		err := q.check()
+		if (err != nil) != c.err {
+			t.Errorf("%+v: expected error: %v, got %v", c.q, c.err, err)
+			continue
+		}
+		if !c.err && (q.Limit != c.expected.Limit || q.Offset != c.expected.Offset || q.Options != c.expected.Options) {
+			t.Errorf("%+v: expected %+v, got %+v", c.q, c.expected, q)
+		}
+	}
+
+}
+
+func TestQueryFilter(t *testing.T) {
+
+	function, _ := (&index.Payload{Type: "function", Class: "Foo"}).MarshalBinary()
+	variable, _ := (&index.Payload{Type: "variable", Class: "Bar"}).MarshalBinary()
+	matches := []index.Match{
+		{Value: []byte("f"), Score: 10, Payload: function},
+		{Value: []byte("v"), Score: 5, Payload: variable},
+		{Value: []byte("none"), Score: 7},
+		{Value: []byte("corrupt"), Score: 9, Payload: []byte{0xff}},
+	}
+
+	three := 3
+	seven := 7
+
+	cases := []struct {
+		filters queryFilters
+		// passed has the values of the matches that pass, or is nil if there's no filter at all
+		passed []string
+	}{
+		{queryFilters{}, nil},
+		{queryFilters{Type: "function"}, []string{"f"}},
+		{queryFilters{Class: "Bar"}, []string{"v"}},
+		{queryFilters{Type: "function", Class: "Bar"}, []string{}},
+		{queryFilters{MinScore: &seven}, []string{"f", "none", "corrupt"}},
+		{queryFilters{MinScore: &three, Type: "variable"}, []string{"v"}},
+	}
+
+	for _, c := range cases {
+
+		q := &query{Filters: c.filters}
+		filter := q.filter()
+		if (filter == nil) != (c.passed == nil) {
+			t.Errorf("%+v: expected a filter: %v, got %v", c.filters, c.passed != nil, filter != nil)
+			continue
+		}
+		if filter == nil {
+			continue
+		}
+
+		passed := []string{}
+		for i := range matches {
+			if filter(&matches[i]) {
+				passed = append(passed, string(matches[i].Value))
+			}
+		}
+		if len(passed) != len(c.passed) {
+			t.Errorf("%+v: expected %v to pass, got %v", c.filters, c.passed, passed)
+			continue
+		}
+		for i := range passed {
+			if passed[i] != c.passed[i] {
+				t.Errorf("%+v: expected %v to pass, got %v", c.filters, c.passed, passed)
+				break
+			}
+		}
+
+	}
+
+}
+
+func TestHighlight(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		handler  http.HandlerFunc
+		method   string
+		target   string
+		body     string
+		expected string
+	}{
+		// highlighting takes work, so it's left out unless it's asked for
+		{indexes.handleComplete, http.MethodGet, "/v1/complete?q=foo&limit=1", "",
+			`{"results":[{"name":"foo_bar","score":10,"key":"foo_bar","data":{"type":"function","class":"Foo"}}],"more":true}`},
+		{indexes.handleComplete, http.MethodGet, "/v1/complete?q=foo&limit=1&highlight=false", "",
+			`{"results":[{"name":"foo_bar","score":10,"key":"foo_bar","data":{"type":"function","class":"Foo"}}],"more":true}`},
+		{indexes.handleComplete, http.MethodGet, "/v1/complete?q=foo&limit=1&highlight=true", "",
+			`{"results":[{"name":"foo_bar","score":10,"key":"foo_bar","matches":[{"start":0,"end":3}],"data":{"type":"function","class":"Foo"}}],"more":true}`},
+		{indexes.handleComplete, http.MethodPost, "/v1/complete", `{"prefix":"gUN","options":{"mode":"abbrev","highlight":true}}`,
+			`{"results":[{"name":"getUserName","score":7,"key":"getUserName","matches":[{"start":0,"end":1},{"start":3,"end":4},{"start":7,"end":8}]}],"more":false}`},
+		{indexes.handleIndex, http.MethodGet, "/v1/indexes/test/complete/food?highlight=1", "",
+			`{"results":[{"name":"food","score":2,"key":"food","matches":[{"start":0,"end":4}]}],"more":false}`},
+		// the legacy route has nowhere to put highlights
+		{handleHTTP, http.MethodGet, "/food?highlight=true", "", `[{"name":"food","score":2}]`},
+	}
+
+	for _, c := range cases {
+		w := serve(c.handler, c.method, c.target, c.body)
+		if w.Code != http.StatusOK || w.Body.String() != c.expected+"\n" {
+			t.Errorf("%s %s %s: expected %s, got %d %s", c.method, c.target, c.body, c.expected, w.Code, w.Body)
+		}
+	}
+
+}
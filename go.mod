@@ -0,0 +1,5 @@
+module github.com/goldibex/prefixserver
+
+go 1.24.0
+
+require golang.org/x/text v0.30.0
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The gRPC service described by prefixserver.proto is served over HTTP/2 by net/http, following
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md. Messages may be sent uncompressed or gzipped,
+// and are answered in the encoding they're sent in.
+
+const grpcService = "/prefixserver.v1.Completion/"
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcCancelled         = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+)
+
+// grpcError is an error to be returned to a gRPC client with the given status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// handleGRPC serves the gRPC service's methods.
+func (s *indexSet) handleGRPC(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+		http.Error(w, "this server speaks gRPC only", http.StatusBadRequest)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/grpc" && contentType != "application/grpc+proto" {
+		http.Error(w, "this server speaks gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Accept-Encoding", "gzip")
+
+	var err error
+	encoding := r.Header.Get("Grpc-Encoding")
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		w.Header().Set("Grpc-Encoding", "gzip")
+	default:
+		err = &grpcError{grpcUnimplemented, fmt.Sprintf("unsupported grpc-encoding %q", encoding)}
+	}
+	gzipped := encoding == "gzip"
+
+	w.WriteHeader(http.StatusOK)
+
+	// the call is abandoned when the client goes away, or when the deadline it set passes
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		if d, ok := parseGRPCTimeout(timeout); ok {
+			ctx, cancel = context.WithTimeout(ctx, d)
+		} else {
+			err = &grpcError{grpcInvalidArgument, fmt.Sprintf("malformed grpc-timeout %q", timeout)}
+		}
+	}
+	defer cancel()
+
+	if err == nil {
+		switch r.URL.Path {
+		case grpcService + "Complete":
+			err = s.grpcComplete(ctx, w, r, gzipped)
+		case grpcService + "CompleteStream":
+			err = s.grpcCompleteStream(ctx, w, r, gzipped)
+		default:
+			err = &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path)}
+		}
+	}
+
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		if gerr, ok := err.(*grpcError); ok {
+			code = gerr.code
+		}
+		logger.Debugf("(%s) gRPC %s: %d (%s)", r.RemoteAddr, r.URL.Path, code, msg)
+	}
+
+	// the status goes in trailers, after all the response messages
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+
+}
+
+// parseGRPCTimeout parses the value of a grpc-timeout header, which is up to 8 digits followed by a unit:
+// H, M or S for hours, minutes or seconds, or m, u or n for milli-, micro- or nanoseconds.
+// Timeouts too long to be represented are cut down to the longest that can.
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 || v[0] == '+' {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+
+	if n > int64(math.MaxInt64/unit) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(n) * unit, true
+
+}
+
+// contextError returns the gRPC error for a call abandoned because ctx is done.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &grpcError{grpcDeadlineExceeded, "the deadline was exceeded"}
+	}
+	return &grpcError{grpcCancelled, "the call was cancelled"}
+}
+
+// grpcComplete serves the unary Complete method. Its messages are gzipped if gzipped is set.
+func (s *indexSet) grpcComplete(ctx context.Context, w http.ResponseWriter, r *http.Request, gzipped bool) error {
+
+	msg, err := readGRPCMessage(r.Body, gzipped)
+	if err == io.EOF {
+		return &grpcError{grpcInvalidArgument, "no request was sent"}
+	}
+	if err != nil {
+		return err
+	}
+
+	q := &query{}
+	id, err := decodeCompleteRequest(msg, q)
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	q.done = ctx.Done()
+	resp, err := s.grpcRun(q)
+	if err != nil {
+		return err
+	}
+	if resp == nil || ctx.Err() != nil {
+		return contextError(ctx)
+	}
+
+	return writeGRPCMessage(w, encodeCompleteResponse(resp, id), gzipped)
+
+}
+
+// grpcCompleteStream serves the CompleteStream method, answering requests in the order they arrive.
+// Each request that arrives abandons the one before it, whether it's still waiting for a results buffer
+// or already being searched for, and the answer to a request that was abandoned is dropped,
+// so that the client only hears about the latest prefix it has sent.
+// Once ctx is done the call ends, without waiting for any more requests. Its messages are gzipped if gzipped is set.
+func (s *indexSet) grpcCompleteStream(ctx context.Context, w http.ResponseWriter, r *http.Request, gzipped bool) error {
+
+	type request struct {
+		q      query
+		id     uint64
+		cancel context.CancelFunc
+	}
+
+	// pending holds the latest request not yet started; the reader replaces any older one
+	pending := make(chan *request, 1)
+	var readErr error
+
+	go func() {
+
+		defer close(pending)
+		var last *request
+
+		for {
+
+			msg, err := readGRPCMessage(r.Body, gzipped)
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+
+			req := &request{}
+			if req.id, err = decodeCompleteRequest(msg, &req.q); err != nil {
+				readErr = &grpcError{grpcInvalidArgument, err.Error()}
+				return
+			}
+
+			reqCtx, cancel := context.WithCancel(ctx)
+			req.q.done, req.cancel = reqCtx.Done(), cancel
+			if last != nil {
+				last.cancel()
+			}
+			last = req
+
+			select {
+			case <-pending:
+			default:
+			}
+			pending <- req
+
+		}
+
+	}()
+
+	for {
+
+		var req *request
+		select {
+		case req = <-pending:
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+		if req == nil {
+			return readErr
+		}
+
+		resp, err := s.grpcRun(&req.q)
+		stale := false
+		select {
+		case <-req.q.done:
+			stale = true
+		default:
+		}
+		req.cancel()
+
+		if err != nil {
+			return err
+		}
+		if stale {
+			continue
+		}
+
+		if err := writeGRPCMessage(w, encodeCompleteResponse(resp, req.id), gzipped); err != nil {
+			return err
+		}
+
+	}
+
+}
+
+// grpcRun checks q and runs it against the index it names.
+// The response is nil if q is abandoned before it's run.
+func (s *indexSet) grpcRun(q *query) (*response, error) {
+
+	if err := q.check(); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	f := s.Default()
+	if q.Index != "" {
+		var ok bool
+		if f, ok = s.byName[q.Index]; !ok {
+			return nil, &grpcError{grpcNotFound, fmt.Sprintf("no index named %s", q.Index)}
+		}
+	}
+
+	return runPooled(q, f.Index()), nil
+
+}
+
+// readGRPCMessage reads a length-prefixed message from r. It returns io.EOF if r ends between messages.
+// Messages flagged as compressed are gunzipped if gzipped is set, and are an error otherwise.
+func readGRPCMessage(r io.Reader, gzipped bool) ([]byte, error) {
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+
+	compressed := prefix[0] == 1
+	if prefix[0] > 1 {
+		return nil, &grpcError{grpcInvalidArgument, "malformed message prefix"}
+	}
+	if compressed && !gzipped {
+		return nil, &grpcError{grpcInternal, "compressed message without a grpc-encoding"}
+	}
+
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxQueryBody {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("messages may be at most %d bytes", maxQueryBody)}
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+
+	if compressed {
+		return gunzipGRPCMessage(msg)
+	}
+	return msg, nil
+
+}
+
+// gunzipGRPCMessage decompresses a gzipped message, which mustn't come to more than maxQueryBody bytes.
+func gunzipGRPCMessage(msg []byte) ([]byte, error) {
+
+	zr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, &grpcError{grpcInternal, fmt.Sprintf("decompressing message: %s", err)}
+	}
+
+	msg, err = io.ReadAll(io.LimitReader(zr, maxQueryBody+1))
+	if err != nil {
+		return nil, &grpcError{grpcInternal, fmt.Sprintf("decompressing message: %s", err)}
+	}
+	if len(msg) > maxQueryBody {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("messages may be at most %d bytes", maxQueryBody)}
+	}
+
+	return msg, nil
+
+}
+
+// writeGRPCMessage writes msg to w with its length prefix, gzipping it first if gzipped is set, and flushes it to the client.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte, gzipped bool) error {
+
+	var flag byte
+	if gzipped {
+		buf := bytes.Buffer{}
+		zw := gzip.NewWriter(&buf)
+		zw.Write(msg)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		msg, flag = buf.Bytes(), 1
+	}
+
+	framed := make([]byte, 5, 5+len(msg))
+	framed[0] = flag
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(msg)))
+	framed = append(framed, msg...)
+
+	if _, err := w.Write(framed); err != nil {
+		return err
+	}
+
+	return http.NewResponseController(w).Flush()
+
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startGRPCServer starts an HTTP/2 server for the gRPC service over the indexes set up by startTestServer.
+func startGRPCServer() *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(indexes.handleGRPC))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv
+}
+
+// grpcFrame frames msg as a gRPC message.
+func grpcFrame(msg string) []byte {
+	framed := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(msg)))
+	return append(framed, msg...)
+}
+
+// grpcRequest encodes a CompleteRequest for prefix in the index named test, with the given id.
+func grpcRequest(prefix string, id uint64) string {
+	var b pbBuffer
+	b.string(1, prefix)
+	b.string(2, "test")
+	b.varint(7, id)
+	return string(b)
+}
+
+// grpcAnswer decodes the names of the results in a CompleteResponse, and its id.
+func grpcAnswer(t *testing.T, msg []byte) ([]string, uint64) {
+
+	names := []string{}
+	var id uint64
+
+	r := pbReader{data: msg}
+	for {
+		field, _, v, b, ok := r.next()
+		if !ok {
+			break
+		}
+		switch field {
+		case 1:
+			res := pbReader{data: b}
+			for {
+				field, _, _, b, ok := res.next()
+				if !ok {
+					break
+				}
+				if field == 1 {
+					names = append(names, string(b))
+				}
+			}
+		case 3:
+			id = v
+		}
+	}
+
+	if r.err != nil {
+		t.Fatalf("decoding %q: %s", msg, r.err)
+	}
+	return names, id
+
+}
+
+// readFrames reads the gRPC messages in body until it ends, gunzipping them if gzipped is set.
+func readFrames(t *testing.T, body io.Reader, gzipped bool) [][]byte {
+	msgs := [][]byte{}
+	for {
+		msg, err := readGRPCMessage(body, gzipped)
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatalf("reading response: %s", err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestGRPCComplete(t *testing.T) {
+
+	defer startTestServer(t)()
+	srv := startGRPCServer()
+	defer srv.Close()
+
+	cases := []struct {
+		method  string
+		body    []byte
+		names   []string
+		status  string
+		message string
+	}{
+		{"Complete", grpcFrame(grpcRequest("foo_b", 7)), []string{"foo_bar", "foo_baz"}, "0", ""},
+		{"Complete", grpcFrame(grpcRequest("nothing", 7)), []string{}, "0", ""},
+		{"Complete", grpcFrame("\x0a\x03foo\x12\x04nope"), nil, "5", "no index named nope"},
+		{"Complete", grpcFrame("\x0a\x03foo\x20\x01\x18" + minusOne), nil, "3", "limit must not be negative"},
+		{"Complete", grpcFrame("\x0a"), nil, "3", "malformed protocol buffer message"},
+		{"Complete", nil, nil, "3", "no request was sent"},
+		{"Complete", grpcFrame("\x0a\x03foo")[:6], nil, "3", "truncated message"},
+		{"Complete", append([]byte{1}, grpcFrame("\x0a\x03foo")[1:]...), nil, "13", "compressed message without a grpc-encoding"},
+		{"Complete", append([]byte{2}, grpcFrame("\x0a\x03foo")[1:]...), nil, "3", "malformed message prefix"},
+		{"Find", grpcFrame("\x0a\x03foo"), nil, "12", "unknown method /prefixserver.v1.Completion/Find"},
+	}
+
+	for _, c := range cases {
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+grpcService+c.method, bytes.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %q: %s", c.method, c.body, err)
+		}
+		msgs := readFrames(t, resp.Body, false)
+		resp.Body.Close()
+
+		if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("%s %q: expected a 200 of application/grpc over HTTP/2, got %d of %s over %s", c.method, c.body, resp.StatusCode, resp.Header.Get("Content-Type"), resp.Proto)
+		}
+
+		// the status comes in the trailers, whether or not there's a message before it
+		status := resp.Trailer.Get("Grpc-Status")
+		message, err := url.PathUnescape(resp.Trailer.Get("Grpc-Message"))
+		if err != nil || status != c.status || message != c.message {
+			t.Errorf("%s %q: expected status %s (%s), got %s (%s)", c.method, c.body, c.status, c.message, status, message)
+		}
+
+		if c.names == nil {
+			if len(msgs) != 0 {
+				t.Errorf("%s %q: expected no messages after an error, got %q", c.method, c.body, msgs)
+			}
+			continue
+		}
+
+		if len(msgs) != 1 {
+			t.Errorf("%s %q: expected one message, got %q", c.method, c.body, msgs)
+			continue
+		}
+		names, id := grpcAnswer(t, msgs[0])
+		if id != 7 || len(names) != len(c.names) {
+			t.Errorf("%s %q: expected %q for id 7, got %q for id %d", c.method, c.body, c.names, names, id)
+			continue
+		}
+		for i := range names {
+			if names[i] != c.names[i] {
+				t.Errorf("%s %q: expected %q, got %q", c.method, c.body, c.names, names)
+				break
+			}
+		}
+
+	}
+
+	// gRPC needs HTTP/2
+	http1 := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := http1.Post(srv.URL+grpcService+"Complete", "application/grpc", bytes.NewReader(grpcFrame("\x0a\x03foo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected HTTP/1.1 to get status 400, got %d", resp.StatusCode)
+	}
+
+}
+
+func TestGRPCCompression(t *testing.T) {
+
+	defer startTestServer(t)()
+	srv := startGRPCServer()
+	defer srv.Close()
+
+	gzipped := bytes.Buffer{}
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(grpcRequest("foo_b", 7)))
+	zw.Close()
+	compressed := append([]byte{1}, grpcFrame(gzipped.String())[1:]...)
+
+	cases := []struct {
+		encoding string
+		body     []byte
+		status   string
+	}{
+		// a gzipped call is answered in gzip
+		{"gzip", compressed, "0"},
+		// and a client that says it uses gzip may still send a message uncompressed
+		{"gzip", grpcFrame(grpcRequest("foo_b", 7)), "0"},
+		{"identity", grpcFrame(grpcRequest("foo_b", 7)), "0"},
+		{"gzip", append([]byte{1}, grpcFrame("not gzip")[1:]...), "13"},
+		{"br", grpcFrame(grpcRequest("foo_b", 7)), "12"},
+	}
+
+	for _, c := range cases {
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+grpcService+"Complete", bytes.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Grpc-Encoding", c.encoding)
+
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoding := resp.Header.Get("Grpc-Encoding")
+		msgs := readFrames(t, resp.Body, encoding == "gzip")
+		resp.Body.Close()
+
+		// the server always says which encodings it takes
+		if accept := resp.Header.Get("Grpc-Accept-Encoding"); accept != "gzip" {
+			t.Errorf("%s: expected grpc-accept-encoding gzip, got %q", c.encoding, accept)
+		}
+		if status := resp.Trailer.Get("Grpc-Status"); status != c.status {
+			t.Errorf("%s %q: expected status %s, got %s (%s)", c.encoding, c.body, c.status, status, resp.Trailer.Get("Grpc-Message"))
+			continue
+		}
+		if c.status != "0" {
+			continue
+		}
+
+		if (encoding == "gzip") != (c.encoding == "gzip") {
+			t.Errorf("%s: expected the answer in the encoding of the call, got %q", c.encoding, encoding)
+		}
+		if len(msgs) != 1 {
+			t.Errorf("%s: expected one message, got %q", c.encoding, msgs)
+			continue
+		}
+		if names, id := grpcAnswer(t, msgs[0]); id != 7 || len(names) != 2 || names[0] != "foo_bar" {
+			t.Errorf("%s: expected foo_bar and foo_baz for id 7, got %q for id %d", c.encoding, names, id)
+		}
+
+	}
+
+}
+
+func TestGRPCCompleteStream(t *testing.T) {
+
+	defer startTestServer(t)()
+	srv := startGRPCServer()
+	defer srv.Close()
+
+	body, requests := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+grpcService+"CompleteStream", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+
+	go requests.Write(grpcFrame(grpcRequest("foo_b", 1)))
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// each request is answered as it's sent, while the stream stays open
+	for _, c := range []struct {
+		prefix string
+		id     uint64
+		first  string
+	}{
+		{"foo_b", 1, "foo_bar"},
+		{"get", 2, "getUserName"},
+		{"foo_q", 3, "foo_qux"},
+	} {
+
+		if c.id > 1 {
+			if _, err := requests.Write(grpcFrame(grpcRequest(c.prefix, c.id))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		msg, err := readGRPCMessage(resp.Body, false)
+		if err != nil {
+			t.Fatalf("reading the answer to %d: %s", c.id, err)
+		}
+		if names, id := grpcAnswer(t, msg); id != c.id || len(names) == 0 || names[0] != c.first {
+			t.Errorf("expected %s first for id %d, got %q for id %d", c.first, c.id, names, id)
+		}
+
+	}
+
+	// of requests sent faster than they're answered, some may be dropped, but never the latest
+	burst := []byte{}
+	for id := uint64(4); id <= 20; id++ {
+		burst = append(burst, grpcFrame(grpcRequest("foo", id))...)
+	}
+	if _, err := requests.Write(burst); err != nil {
+		t.Fatal(err)
+	}
+	requests.Close()
+
+	msgs := readFrames(t, resp.Body, false)
+	var last uint64 = 3
+	for _, msg := range msgs {
+		_, id := grpcAnswer(t, msg)
+		if id <= last {
+			t.Errorf("expected answers in the order they were asked, got %d after %d", id, last)
+		}
+		last = id
+	}
+	if last != 20 {
+		t.Errorf("expected the latest request to be answered, got %d last", last)
+	}
+
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("expected status 0, got %s (%s)", status, resp.Trailer.Get("Grpc-Message"))
+	}
+
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+
+	cases := []struct {
+		v  string
+		d  time.Duration
+		ok bool
+	}{
+		{"1H", time.Hour, true},
+		{"90M", 90 * time.Minute, true},
+		{"5S", 5 * time.Second, true},
+		{"250m", 250 * time.Millisecond, true},
+		{"7u", 7 * time.Microsecond, true},
+		{"12345678n", 12345678, true},
+		{"0S", 0, true},
+		// the longest timeout there's room for is about 11,000 years, which hours can exceed
+		{"99999999H", math.MaxInt64, true},
+		{"", 0, false},
+		{"S", 0, false},
+		{"5", 0, false},
+		{"5s", 0, false},
+		{"123456789S", 0, false},
+		{"-5S", 0, false},
+		{"+5S", 0, false},
+		{"5 S", 0, false},
+	}
+
+	for _, c := range cases {
+		if d, ok := parseGRPCTimeout(c.v); d != c.d || ok != c.ok {
+			t.Errorf("%q: expected %s (%v), got %s (%v)", c.v, c.d, c.ok, d, ok)
+		}
+	}
+
+}
+
+func TestGRPCTimeout(t *testing.T) {
+
+	defer startTestServer(t)()
+	srv := startGRPCServer()
+	defer srv.Close()
+
+	// call makes a call with the given timeout, and returns its status
+	call := func(method string, timeout string, body io.Reader) string {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+grpcService+method, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Grpc-Timeout", timeout)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		readFrames(t, resp.Body, false)
+		return resp.Trailer.Get("Grpc-Status")
+	}
+
+	for _, c := range []struct {
+		timeout string
+		status  string
+	}{
+		{"1M", "0"},
+		{"1n", "4"},
+		{"soon", "3"},
+	} {
+		if status := call("Complete", c.timeout, bytes.NewReader(grpcFrame(grpcRequest("foo", 1)))); status != c.status {
+			t.Errorf("timeout %s: expected status %s, got %s", c.timeout, c.status, status)
+		}
+	}
+
+	// a stream ends at its deadline, even while waiting for the client
+	body, requests := io.Pipe()
+	defer requests.Close()
+	go requests.Write(grpcFrame(grpcRequest("foo", 1)))
+	begun := time.Now()
+	if status := call("CompleteStream", "100m", body); status != "4" {
+		t.Errorf("expected a stream to end with status 4, got %s", status)
+	}
+	if elapsed := time.Since(begun); elapsed > 5*time.Second {
+		t.Errorf("expected the stream to end at its deadline, took %s", elapsed)
+	}
+
+}
+
+func TestRunPooledAbandoned(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	// with every buffer taken, a query waits until it's abandoned
+	taken := []*resultsBuffer{<-pool, <-pool}
+	done := make(chan struct{})
+	close(done)
+	if resp := runPooled(&query{Prefix: "foo", Limit: 1, done: done}, indexes.Default().Index()); resp != nil {
+		t.Errorf("expected no response to an abandoned query, got %+v", resp)
+	}
+
+	for _, buf := range taken {
+		pool <- buf
+	}
+	if resp := runPooled(&query{Prefix: "foo", Limit: 1}, indexes.Default().Index()); resp == nil || len(resp.Results) != 1 {
+		t.Errorf("expected a result once buffers are free, got %+v", resp)
+	}
+
+}
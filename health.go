@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// startedAt is when the server process started, for /v1/info.
+var startedAt = time.Now()
+
+// handleHealth serves /healthz, which succeeds for as long as the server can answer at all.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady serves /readyz, which fails while any index is being loaded, and once the
+// server starts shutting down, so that load balancers only send it traffic it can handle.
+func (s *indexSet) handleReady(w http.ResponseWriter, r *http.Request) {
+
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(w, "not ready: shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, f := range s.files {
+		if !f.loaded() {
+			http.Error(w, fmt.Sprintf("not ready: loading index %s", f.name), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+
+}
+
+// handleInfo serves /v1/info, which describes the server and each of its indexes in detail.
+func (s *indexSet) handleInfo(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := struct {
+		StartedAt time.Time     `json:"started_at"`
+		GoVersion string        `json:"go_version"`
+		Indexes   []indexStatus `json:"indexes"`
+	}{
+		StartedAt: startedAt.UTC(),
+		GoVersion: runtime.Version(),
+		Indexes:   make([]indexStatus, len(s.files)),
+	}
+
+	for i, f := range s.files {
+		info.Indexes[i] = f.status()
+	}
+
+	writeJSON(w, r, http.StatusOK, &info)
+
+}
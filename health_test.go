@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInfoChecksum(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	// a file without a header has nothing recording its checksum, so it's hashed
+	plain := filepath.Join(filepath.Dir(indexes.files[0].path), "plain.index")
+	file, err := os.Create(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := index.New()
+	in.Add([]byte("foo"), []byte("foo"), 1)
+	if err := gob.NewEncoder(file).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	f := newIndexFile("plain", plain)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	indexes.files = append(indexes.files, f)
+
+	w := serve(indexes.handleInfo, http.MethodGet, "/v1/info", "")
+	info := struct {
+		Indexes []indexStatus `json:"indexes"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("decoding %s: %s", w.Body, err)
+	}
+	if len(info.Indexes) != 3 {
+		t.Fatalf("expected 3 indexes, got %d", len(info.Indexes))
+	}
+
+	st := info.Indexes[0]
+	if st.Header == nil {
+		t.Fatalf("expected %s to have a header", st.Name)
+	}
+	if expected := fmt.Sprintf("crc32c:%08x", st.Header.BodyCRC32C); st.Checksum != expected {
+		t.Errorf("expected %s to report the checksum from its header, %s, got %s", st.Name, expected, st.Checksum)
+	}
+
+	data, err := ioutil.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if st := info.Indexes[2]; st.Checksum != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the SHA-256 of a file without a header, got %s", st.Checksum)
+	}
+
+}
@@ -0,0 +1,315 @@
+package prefixserver
+
+// FindAbbrev locates up to len(matches) entries whose keys abbreviate to abbrev, as IDEs complete names:
+// getUserName is found by gUN, getUN, gUsName or getUserName. The first byte of abbrev must match the start
+// of the key, and each byte after it must either continue the run of bytes just matched, or match at the start
+// of a later word, which is a capital letter, a digit following a non-digit, or whatever follows a separator
+// such as _ . - / or a space. Letters match regardless of case, except that a capital in abbrev only matches
+// a capital partway through a word. Entries are ranked by score less penalty for each jump to a new word after
+// the first, so that keys abbrev is a plain prefix of come first, and the first offset of them are skipped.
+// Keys that have been case folded have no capitals left, so searched through WithKeyForm, words in them begin
+// where they do in the values they were made from, wherever a key can be found in its value.
+// FindAbbrev returns the number of matches stored.
+func (in *Index) FindAbbrev(abbrev []byte, penalty int, offset int, matches []Match) int {
+	return searchQuery(in, &Query{Prefix: abbrev, Abbrev: true, Penalty: penalty}, offset, matches)
+}
+
+// FindAbbrev locates up to len(matches) entries whose keys abbreviate to abbrev, as Index.FindAbbrev does.
+func (m *Mapped) FindAbbrev(abbrev []byte, penalty int, offset int, matches []Match) int {
+	return searchQuery(m, &Query{Prefix: abbrev, Abbrev: true, Penalty: penalty}, offset, matches)
+}
+
+// abbrevState is the progress of an abbreviation search along one path through the index.
+// The search is a nondeterministic automaton whose states are how many bytes of the abbreviation
+// have been matched, and whether the last byte of the path was one of them, so that the next can continue its run.
+type abbrevState struct {
+	// jumps[2*i+1] is the fewest jumps to new words with which the first i bytes of the abbreviation
+	// can be matched by the path so far, ending with its last byte; jumps[2*i] is the same for paths
+	// whose last byte wasn't matched. -1 means the state can't be reached.
+	jumps []int
+	// prev is the last byte of the path, which decides whether the next begins a word
+	prev byte
+	// done is the fewest jumps with which the whole abbreviation has been matched, or -1 if it hasn't been
+	done int
+	// bound is the fewest jumps in any state, which no match at or below the node can better
+	bound int
+}
+
+type abbrevMatcher struct {
+	abbrev  []byte
+	penalty int
+	// form is the key form of the index. If it folds case, any byte but a separator may begin a word
+	// as far as the search is concerned, and each match is settled against its value's word starts
+	form KeyForm
+}
+
+func (m *abbrevMatcher) start(root *node) *queueElement {
+
+	jumps := make([]int, 2*(len(m.abbrev)+1))
+	for i := range jumps {
+		jumps[i] = -1
+	}
+	// the start of the key counts as the end of a run, which its first byte continues
+	jumps[1] = 0
+
+	state := &abbrevState{jumps: jumps, done: -1}
+	if len(m.abbrev) == 0 {
+		state.done = 0
+	}
+
+	return &queueElement{node: root, abbrev: state}
+
+}
+
+func (m *abbrevMatcher) step(e *queueElement) (queueElement, bool) {
+
+	next := *e
+	if len(e.key) == 0 {
+		return next, e.abbrev.bound >= 0
+	}
+
+	n := len(m.abbrev)
+	jumps := e.abbrev.jumps
+	prev := e.abbrev.prev
+
+	for _, c := range e.key {
+
+		// the path so far is empty exactly when only the starting state can be reached
+		wordStart := prev == 0 || isWordStart(prev, c) || (m.form.Fold != FoldNone && !isSeparator(c))
+
+		nextJumps := make([]int, len(jumps))
+		for i := range nextJumps {
+			nextJumps[i] = -1
+		}
+		reachable := false
+
+		for i := 0; i <= n; i++ {
+			for live := 0; live < 2; live++ {
+
+				j := jumps[2*i+live]
+				if j < 0 {
+					continue
+				}
+
+				// skip c, which the key's first byte can't be unless the abbreviation is empty
+				if i > 0 || n == 0 {
+					nextJumps[2*i] = minJumps(nextJumps[2*i], j)
+					reachable = true
+				}
+
+				// or match it with the next byte of the abbreviation
+				if i < n && abbrevByteMatches(m.abbrev[i], c, wordStart) && (live == 1 || wordStart) {
+					cost := j
+					if live == 0 {
+						cost++
+					}
+					nextJumps[2*(i+1)+1] = minJumps(nextJumps[2*(i+1)+1], cost)
+					reachable = true
+				}
+
+			}
+		}
+
+		if !reachable {
+			return next, false
+		}
+
+		jumps, prev = nextJumps, c
+
+	}
+
+	state := &abbrevState{jumps: jumps, prev: prev, done: minJumps(jumps[2*n], jumps[2*n+1]), bound: -1}
+	for _, j := range jumps {
+		state.bound = minJumps(state.bound, j)
+	}
+
+	next.abbrev = state
+	return next, true
+
+}
+
+func (m *abbrevMatcher) admit(e *queueElement) bool {
+
+	if e.value != nil {
+		// a leaf's jumps are settled, so rank it by them exactly
+		done := e.abbrev.done
+		if m.form.Fold != FoldNone && done >= 0 {
+			key := e.path()
+			done = leastJumps(m.abbrev, key, m.wordStart(e.value, key))
+		}
+		e.cost = done * m.penalty
+		return done >= 0
+	}
+
+	e.cost = e.abbrev.bound * m.penalty
+	return true
+
+}
+
+func (m *abbrevMatcher) matched(e *queueElement) bool {
+	return e.abbrev.done >= 0
+}
+
+// spans works out which bytes of key the abbreviation matched, which the search itself doesn't keep track of,
+// choosing among the ways of matching it with the fewest jumps the one that runs on the longest before each.
+func (m *abbrevMatcher) spans(e *queueElement, key []byte) []span {
+
+	n := len(m.abbrev)
+	if n == 0 || len(key) == 0 {
+		return nil
+	}
+
+	wordStart := m.wordStart(e.value, key)
+	jumps := abbrevTable(m.abbrev, key, wordStart)
+	if jumps[0][0] < 0 {
+		return nil
+	}
+
+	spans := []span{{0, 1}}
+	p := 0
+	for i := 1; i < n; i++ {
+
+		// carry on the run if that's as good as jumping, or else take the first jump that's best
+		want := jumps[i-1][p]
+		next := -1
+		for q := p + 1; q < len(key) && next < 0; q++ {
+			j := jumps[i][q]
+			if j < 0 || (q > p+1 && !wordStart(q)) {
+				continue
+			}
+			if q > p+1 {
+				j++
+			}
+			if j == want {
+				next = q
+			}
+		}
+
+		if next == p+1 {
+			spans[len(spans)-1].end++
+		} else {
+			spans = append(spans, span{next, next + 1})
+		}
+		p = next
+
+	}
+
+	return spans
+
+}
+
+// abbrevTable works out the ways abbrev can abbreviate key, whose words begin where wordStart says,
+// for which abbrev and key mustn't be empty. In the table it returns, jumps[i][p] is the fewest jumps with which
+// the rest of abbrev after byte i can be matched when byte i is matched by key[p], or -1 if it can't be.
+func abbrevTable(abbrev, key []byte, wordStart func(p int) bool) [][]int {
+
+	n := len(abbrev)
+	jumps := make([][]int, n)
+	for i := n - 1; i >= 0; i-- {
+		jumps[i] = make([]int, len(key))
+		for p := range key {
+			jumps[i][p] = -1
+			if !abbrevByteMatches(abbrev[i], key[p], wordStart(p)) {
+				continue
+			}
+			if i == n-1 {
+				jumps[i][p] = 0
+				continue
+			}
+			for q := p + 1; q < len(key); q++ {
+				if j := jumps[i+1][q]; j >= 0 && (q == p+1 || wordStart(q)) {
+					if q > p+1 {
+						j++
+					}
+					jumps[i][p] = minJumps(jumps[i][p], j)
+				}
+			}
+		}
+	}
+
+	return jumps
+
+}
+
+// leastJumps returns the fewest jumps to new words with which abbrev abbreviates key,
+// whose words begin where wordStart says, or -1 if it doesn't.
+func leastJumps(abbrev, key []byte, wordStart func(p int) bool) int {
+	if len(abbrev) == 0 {
+		return 0
+	}
+	if len(key) == 0 {
+		return -1
+	}
+	return abbrevTable(abbrev, key, wordStart)[0][0]
+}
+
+// wordStart returns a function reporting whether byte p of key, through which value was found, begins a word.
+// Case folding loses the capitals that begin words, so if the index folds case they're read from value instead,
+// wherever key can be found in it byte for byte.
+func (m *abbrevMatcher) wordStart(value, key []byte) func(p int) bool {
+
+	text := key
+	if m.form.Fold != FoldNone {
+		if start := m.form.locate(value, key); start >= 0 {
+			if unfolded := m.form.normalize(value[start:]); len(m.form.fold(unfolded)) == len(unfolded) {
+				text = unfolded
+			}
+		}
+	}
+
+	return func(p int) bool {
+		return p == 0 || isWordStart(text[p-1], text[p])
+	}
+
+}
+
+// minJumps returns the lesser of a and b, either of which may be -1 for a state that can't be reached.
+func minJumps(a, b int) int {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// isWordStart reports whether c starts a new word when it follows prev.
+func isWordStart(prev, c byte) bool {
+	switch {
+	case isSeparator(c):
+		return false
+	case isSeparator(prev):
+		return true
+	case isUpper(c):
+		return !isUpper(prev)
+	case isDigit(c):
+		return !isDigit(prev)
+	}
+	return false
+}
+
+// abbrevByteMatches reports whether a, from an abbreviation, matches c, from a key.
+func abbrevByteMatches(a, c byte, wordStart bool) bool {
+	if a == c {
+		return true
+	}
+	// a capital partway through a word must be matched exactly
+	return !(isUpper(a) && !wordStart) && toLower(a) == toLower(c)
+}
+
+func isSeparator(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '/' || c == ' ' || c == '$' || c == ':'
+}
+
+func isUpper(c byte) bool {
+	return 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func toLower(c byte) byte {
+	if isUpper(c) {
+		return c + 'a' - 'A'
+	}
+	return c
+}
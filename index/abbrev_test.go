@@ -0,0 +1,266 @@
+package prefixserver
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// abbrevJumps is the fewest jumps to new words with which abbrev abbreviates key, or -1 if it doesn't, worked out naively.
+func abbrevJumps(abbrev, key []byte) int {
+
+	wordStart := func(p int) bool {
+		return p == 0 || isWordStart(key[p-1], key[p])
+	}
+
+	// try matching abbrev[i:] from position p of key, where last is the position of the last byte matched
+	var try func(i, last int) int
+	try = func(i, last int) int {
+
+		if i == len(abbrev) {
+			return 0
+		}
+
+		best := -1
+		for p := last + 1; p < len(key); p++ {
+			start := wordStart(p)
+			if p > last+1 && !start {
+				continue
+			}
+			if !abbrevByteMatches(abbrev[i], key[p], start) {
+				continue
+			}
+			jumps := try(i+1, p)
+			if jumps < 0 {
+				continue
+			}
+			if p > last+1 {
+				jumps++
+			}
+			best = minJumps(best, jumps)
+		}
+
+		return best
+
+	}
+
+	if len(abbrev) == 0 {
+		return 0
+	}
+	if len(key) == 0 || !abbrevByteMatches(abbrev[0], key[0], true) {
+		return -1
+	}
+	return try(1, 0)
+
+}
+
+func TestFindAbbrevLittle(t *testing.T) {
+
+	index := New()
+	for i, value := range []string{"getUserName", "getUsername", "get_user_name", "gunzip", "getName", "setUserName"} {
+		index.Add([]byte(value), []byte(value), i)
+	}
+	index.Compact()
+
+	matches := make([]Match, 10)
+	count := index.FindAbbrev([]byte("gUN"), 100, 0, matches)
+
+	// gunzip has no capitals for U and N to match, and getUsername has no word starting with N
+	expected := []string{"get_user_name", "getUserName"}
+
+	if count != len(expected) {
+		t.Fatalf("expected %d results, got %d: %+v", len(expected), count, matches[0:count])
+	}
+	for i := range expected {
+		if string(matches[i].Value) != expected[i] {
+			t.Errorf("expected result %d to be %s, got %s", i, expected[i], matches[i].Value)
+		}
+	}
+
+	for _, abbrev := range []string{"getUN", "gUsName", "getUserName", "gun", "g"} {
+		found := false
+		count := index.FindAbbrev([]byte(abbrev), 100, 0, matches)
+		for i := 0; i < count; i++ {
+			found = found || string(matches[i].Value) == "getUserName"
+		}
+		if !found {
+			t.Errorf("expected %s to find getUserName, got %+v", abbrev, matches[0:count])
+		}
+	}
+
+	// in lower case, gun is a plain prefix of gunzip, which needs no jumps and so ranks first
+	if count := index.FindAbbrev([]byte("gun"), 100, 0, matches); count != 3 || string(matches[0].Value) != "gunzip" {
+		t.Errorf("expected gun to find gunzip first, then two others, got %+v", matches[0:count])
+	}
+
+	for _, abbrev := range []string{"UN", "gUNx", "gsN", "gUsx"} {
+		if count := index.FindAbbrev([]byte(abbrev), 100, 0, matches); count != 0 {
+			t.Errorf("expected %s to find nothing, got %+v", abbrev, matches[0:count])
+		}
+	}
+
+	if count := index.FindAbbrev(nil, 100, 0, matches); count != 6 {
+		t.Errorf("expected an empty abbreviation to find everything, got %+v", matches[0:count])
+	}
+
+}
+
+func TestFindAbbrev(t *testing.T) {
+
+	const penalty = 300
+
+	index := New()
+	keys := make([][]byte, 2000)
+	scores := make([]int, len(keys))
+	for i := range keys {
+		keys[i] = randBytes()
+		for j := range keys[i] {
+			// a small alphabet with capitals, digits and separators makes word starts common
+			keys[i][j] = "abAB1_"[keys[i][j]%6]
+		}
+		scores[i] = rand.Intn(1000)
+		index.Add(keys[i], keys[i], scores[i])
+	}
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := make([]Match, 20)
+
+	for n := 0; n < 200; n++ {
+
+		abbrev := make([]byte, rand.Intn(4)+1)
+		for j := range abbrev {
+			abbrev[j] = "abAB1_"[rand.Intn(6)]
+		}
+
+		// work out the expected ranks by brute force
+		ranks := []int{}
+		for i := range keys {
+			if jumps := abbrevJumps(abbrev, keys[i]); jumps >= 0 {
+				ranks = append(ranks, scores[i]-jumps*penalty)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(ranks)))
+		if len(ranks) > len(matches) {
+			ranks = ranks[:len(matches)]
+		}
+
+		for _, searcher := range []Searcher{index, mapped} {
+
+			count := searcher.FindAbbrev(abbrev, penalty, 0, matches)
+			if count != len(ranks) {
+				t.Fatalf("%T: for abbreviation %s: expected %d results, got %d", searcher, abbrev, len(ranks), count)
+			}
+
+			for i := 0; i < count; i++ {
+				jumps := abbrevJumps(abbrev, matches[i].Value)
+				if jumps < 0 {
+					t.Fatalf("%T: for abbreviation %s: result %s doesn't match", searcher, abbrev, matches[i].Value)
+				}
+				if rank := matches[i].Score - jumps*penalty; rank != ranks[i] {
+					t.Fatalf("%T: for abbreviation %s: result %d (%s) has rank %d, expected %d", searcher, abbrev, i, matches[i].Value, rank, ranks[i])
+				}
+			}
+
+		}
+
+	}
+
+}
+
+func TestFindAbbrevFolded(t *testing.T) {
+
+	const penalty = 300
+	folded := KeyForm{Fold: FoldUnicode}
+
+	little := New()
+	for i, value := range []string{"getUserName", "getUsername", "get_user_name", "gunzip", "getName", "setUserName"} {
+		little.Add(folded.Key([]byte(value)), []byte(value), i)
+	}
+	little.Compact()
+
+	// the keys have lost their capitals, but the values still say where words begin
+	matches := make([]Match, 10)
+	count := WithKeyForm(little, folded).FindAbbrev([]byte("gUN"), 100, 0, matches)
+	expected := []string{"gunzip", "get_user_name", "getUserName"}
+	if count != len(expected) {
+		t.Fatalf("expected %d results, got %d: %+v", len(expected), count, matches[0:count])
+	}
+	for i := range expected {
+		if string(matches[i].Value) != expected[i] {
+			t.Errorf("expected result %d to be %s, got %s", i, expected[i], matches[i].Value)
+		}
+	}
+
+	index := New()
+	values := make([][]byte, 2000)
+	scores := make([]int, len(values))
+	for i := range values {
+		values[i] = randBytes()
+		for j := range values[i] {
+			values[i][j] = "abAB1_"[values[i][j]%6]
+		}
+		scores[i] = rand.Intn(1000)
+		index.Add(folded.Key(values[i]), values[i], scores[i])
+	}
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches = make([]Match, 20)
+
+	for n := 0; n < 200; n++ {
+
+		abbrev := make([]byte, rand.Intn(4)+1)
+		for j := range abbrev {
+			abbrev[j] = "abAB1_"[rand.Intn(6)]
+		}
+
+		// a folded abbreviation abbreviates a value as it would in any case
+		ranks := []int{}
+		for i := range values {
+			if jumps := abbrevJumps(folded.Key(abbrev), values[i]); jumps >= 0 {
+				ranks = append(ranks, scores[i]-jumps*penalty)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(ranks)))
+		if len(ranks) > len(matches) {
+			ranks = ranks[:len(matches)]
+		}
+
+		for _, searcher := range []Searcher{WithKeyForm(index, folded), WithKeyForm(mapped, folded)} {
+
+			count := searcher.FindAbbrev(abbrev, penalty, 0, matches)
+			if count != len(ranks) {
+				t.Fatalf("%T: for abbreviation %s: expected %d results, got %d", searcher, abbrev, len(ranks), count)
+			}
+
+			for i := 0; i < count; i++ {
+				jumps := abbrevJumps(folded.Key(abbrev), matches[i].Value)
+				if jumps < 0 {
+					t.Fatalf("%T: for abbreviation %s: result %s doesn't match", searcher, abbrev, matches[i].Value)
+				}
+				if rank := matches[i].Score - jumps*penalty; rank != ranks[i] {
+					t.Fatalf("%T: for abbreviation %s: result %d (%s) has rank %d, expected %d", searcher, abbrev, i, matches[i].Value, rank, ranks[i])
+				}
+			}
+
+		}
+
+	}
+
+}
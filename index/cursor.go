@@ -0,0 +1,147 @@
+package prefixserver
+
+import "bytes"
+
+// A Cursor searches for completions of a prefix that changes a little at a time, as it does while someone types.
+// It remembers where in the index each byte of the prefix led, so that when the prefix is extended, the search
+// carries on from where the last one left off rather than starting again from the root, and when it's shortened,
+// the search steps back to where it was.
+//
+// A Cursor is not safe for concurrent use, and it's invalidated by any change to the Index it searches.
+type Cursor struct {
+	t    tree
+	form KeyForm
+	// ties orders the results of queries that don't give their own order
+	ties   TieOrder
+	prefix []byte
+	// path[i] is the element at which a search for the first i bytes of prefix begins,
+	// or nil if nothing in the index begins with them
+	path []*queueElement
+}
+
+// Cursor returns a new Cursor for in, positioned at the empty prefix.
+func (in *Index) Cursor() *Cursor {
+	return newCursor(in)
+}
+
+// Cursor returns a new Cursor for m, positioned at the empty prefix.
+func (m *Mapped) Cursor() *Cursor {
+	return newCursor(m)
+}
+
+func newCursor(t tree) *Cursor {
+	return &Cursor{t: t, path: []*queueElement{{node: t.root()}}}
+}
+
+// Prefix returns the prefix the cursor is positioned at, in the key form of its index.
+func (c *Cursor) Prefix() []byte {
+	return c.prefix
+}
+
+// Set moves the cursor to prefix, keeping its place for as much of prefix as it has in common with the current one.
+func (c *Cursor) Set(prefix []byte) {
+
+	keep := commonPrefixLen(c.prefix, prefix)
+	c.prefix = c.prefix[:keep]
+	c.path = c.path[:keep+1]
+
+	for _, b := range prefix[keep:] {
+		c.push(b)
+	}
+
+}
+
+// push extends the prefix by b, following it down the index from the end of the path.
+func (c *Cursor) push(b byte) {
+
+	c.prefix = append(c.prefix, b)
+
+	e := c.path[len(c.path)-1]
+	if e == nil {
+		c.path = append(c.path, nil)
+		return
+	}
+
+	// the part of the prefix that e's node and its descendants have yet to read
+	unread := len(e.prefix) + 1
+	next := *e
+	next.prefix = c.prefix[len(c.prefix)-unread:]
+
+	// descend while the node's key is used up by the prefix, so that searches start as deep as they can
+	for len(next.prefix) > len(next.key) {
+
+		stepped, ok := exactMatcher(nil).step(&next)
+		if !ok {
+			c.path = append(c.path, nil)
+			return
+		}
+
+		children, first := c.t.children(&next)
+		found := false
+		for i := range children {
+			if len(children[i].key) > 0 && children[i].key[0] == stepped.prefix[0] {
+				parent := next
+				next = stepped
+				next.parent = &parent
+				next.keyLen += len(stepped.key)
+				next.node = &children[i]
+				next.pos = first + uint32(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.path = append(c.path, nil)
+			return
+		}
+
+	}
+
+	// the prefix ends within this node's key, so check that it agrees with it
+	if !bytes.HasPrefix(next.key, next.prefix) {
+		c.path = append(c.path, nil)
+		return
+	}
+
+	c.path = append(c.path, &next)
+
+}
+
+// Search finds matches to q as Index.Search does, first moving the cursor to q.Prefix.
+// Fuzzy and abbreviation queries can't make use of the cursor's place, and search from the root.
+func (c *Cursor) Search(q *Query, offset int, matches []Match) int {
+
+	formed := *q
+	formed.form = c.form
+	if formed.Ties == nil {
+		formed.Ties = c.ties
+	}
+	q = &formed
+
+	c.Set(q.form.Key(q.Prefix))
+
+	if q.MaxEdits > 0 || q.Abbrev {
+		return searchQuery(c.t, q, offset, matches)
+	}
+
+	from := c.path[len(c.path)-1]
+	if from == nil {
+		return 0
+	}
+
+	m := q.wrap(resumeMatcher{exactMatcher: exactMatcher(c.prefix), from: *from})
+	return search(c.t, m, q.Ties, offset, len(matches), q.found(m, matches))
+
+}
+
+// resumeMatcher is an exactMatcher whose search begins partway down the index, where a Cursor left it.
+// Its prefix is only used for highlighting, since the part of it still to be read is kept in from.
+type resumeMatcher struct {
+	exactMatcher
+	from queueElement
+}
+
+func (m resumeMatcher) start(root *node) *queueElement {
+	e := m.from
+	return &e
+}
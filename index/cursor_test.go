@@ -0,0 +1,85 @@
+package prefixserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+
+	index, keys := makeFakeIndex(2000)
+	index.Compact()
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatalf("writing flat index: %s", err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading flat index: %s", err)
+	}
+
+	want := make([]Match, 5)
+	got := make([]Match, 5)
+
+	check := func(s Searcher, c *Cursor, prefix []byte, offset int) {
+
+		wantCount := s.FindMatches(prefix, offset, want)
+		count := c.Search(&Query{Prefix: prefix}, offset, got)
+
+		if !bytes.Equal(c.Prefix(), prefix) {
+			t.Fatalf("%T: expected the cursor to be at %q, got %q", s, prefix, c.Prefix())
+		}
+		if count != wantCount {
+			t.Fatalf("%T: on search for %q, expected %d results, got %d", s, prefix, wantCount, count)
+		}
+		for i := 0; i < count; i++ {
+			if !bytes.Equal(got[i].Value, want[i].Value) || got[i].Score != want[i].Score {
+				t.Fatalf("%T: on search for %q, expected result %d to be %s (%d), got %s (%d)", s, prefix, i, want[i].Value, want[i].Score, got[i].Value, got[i].Score)
+			}
+			if !bytes.Equal(got[i].Key, want[i].Key) {
+				t.Fatalf("%T: on search for %q, expected result %d to be found through %s, got %s", s, prefix, i, want[i].Key, got[i].Key)
+			}
+		}
+
+	}
+
+	for _, s := range []Searcher{index, mapped} {
+
+		c := s.Cursor()
+
+		for i := 0; i < len(keys); i += 97 {
+
+			// type the key a byte at a time, then with a typo, then backspace over it all
+			key := keys[i]
+			for j := 0; j <= len(key); j++ {
+				check(s, c, key[:j], j%2)
+			}
+			typo := append(append([]byte{}, key...), '!', 'x')
+			check(s, c, typo, 0)
+			for j := len(key); j >= 0; j-- {
+				check(s, c, key[:j], 0)
+			}
+
+			// and jump from one key to another
+			check(s, c, keys[(i+1)%len(keys)], 0)
+
+		}
+
+		// fuzzy searches and filters go through the cursor too
+		prefix := keys[0][:1]
+		fuzzy := &Query{Prefix: prefix, MaxEdits: 1, Penalty: 1000}
+		if count, wantCount := c.Search(fuzzy, 0, got), s.FindFuzzy(prefix, 1, 1000, 0, want); count != wantCount {
+			t.Errorf("%T: on fuzzy search for %q, expected %d results, got %d", s, prefix, wantCount, count)
+		}
+		even := &Query{Prefix: prefix, Filter: func(m *Match) bool { return m.Score%2 == 0 }}
+		count := c.Search(even, 0, got)
+		for _, m := range got[:count] {
+			if m.Score%2 != 0 {
+				t.Errorf("%T: expected only even scores, got %d", s, m.Score)
+			}
+		}
+
+	}
+
+}
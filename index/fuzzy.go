@@ -0,0 +1,136 @@
+package prefixserver
+
+// FindFuzzy locates up to len(matches) entries whose keys begin with prefix, give or take
+// up to maxEdits single-byte insertions, deletions and substitutions, and stores them in matches.
+// Entries are ranked by score less penalty for each edit, and the first offset of them are skipped.
+// FindFuzzy returns the number of matches stored.
+func (in *Index) FindFuzzy(prefix []byte, maxEdits int, penalty int, offset int, matches []Match) int {
+	return findFuzzy(in, prefix, maxEdits, penalty, offset, matches)
+}
+
+// FindFuzzy locates up to len(matches) entries whose keys nearly begin with prefix, as Index.FindFuzzy does.
+func (m *Mapped) FindFuzzy(prefix []byte, maxEdits int, penalty int, offset int, matches []Match) int {
+	return findFuzzy(m, prefix, maxEdits, penalty, offset, matches)
+}
+
+func findFuzzy(t tree, prefix []byte, maxEdits int, penalty int, offset int, matches []Match) int {
+	m := &fuzzyMatcher{query: prefix, maxEdits: maxEdits, penalty: penalty}
+	return search(t, m, nil, offset, len(matches), func(i int, e *queueElement) {
+		matches[i] = newMatch(e)
+	})
+}
+
+// fuzzyState is the progress of a fuzzy search along one path through the index,
+// computed a row at a time as in the Wagner-Fischer algorithm.
+type fuzzyState struct {
+	// row[j] is the edit distance between the first j bytes of the query and the path so far
+	row []int
+	// edits is the smallest edit distance between the whole query and any prefix of the path so far,
+	// and end is the length of the longest such prefix
+	edits int
+	end   int
+	// bound is the fewest edits that any match at or below the node could need
+	bound int
+}
+
+// fuzzyMatcher matches every path with a prefix within maxEdits of its query.
+type fuzzyMatcher struct {
+	query    []byte
+	maxEdits int
+	penalty  int
+}
+
+func (m *fuzzyMatcher) start(root *node) *queueElement {
+
+	row := make([]int, len(m.query)+1)
+	for j := range row {
+		row[j] = j
+	}
+
+	return &queueElement{node: root, fuzzy: &fuzzyState{row: row, edits: len(m.query)}}
+
+}
+
+func (m *fuzzyMatcher) step(e *queueElement) (queueElement, bool) {
+
+	next := *e
+	if len(e.key) == 0 {
+		return next, e.fuzzy.bound <= m.maxEdits
+	}
+
+	prev := e.fuzzy.row
+	edits := e.fuzzy.edits
+	end := e.fuzzy.end
+	bound := edits
+
+	for i, c := range e.key {
+
+		row := make([]int, len(prev))
+		row[0] = prev[0] + 1
+		bound = row[0]
+
+		for j := 1; j < len(row); j++ {
+
+			substitution := prev[j-1]
+			if m.query[j-1] != c {
+				substitution++
+			}
+
+			row[j] = substitution
+			if prev[j]+1 < row[j] {
+				row[j] = prev[j] + 1
+			}
+			if row[j-1]+1 < row[j] {
+				row[j] = row[j-1] + 1
+			}
+
+			if row[j] < bound {
+				bound = row[j]
+			}
+
+		}
+
+		if row[len(row)-1] <= edits {
+			edits = row[len(row)-1]
+			end = e.keyLen + i + 1
+		}
+		prev = row
+
+		if edits < bound {
+			bound = edits
+		}
+		if bound > m.maxEdits {
+			// every row from here on can only get worse
+			return next, false
+		}
+
+	}
+
+	next.fuzzy = &fuzzyState{row: prev, edits: edits, end: end, bound: bound}
+	return next, true
+
+}
+
+func (m *fuzzyMatcher) admit(e *queueElement) bool {
+
+	if e.value != nil {
+		// a leaf's edits are settled, so rank it by them exactly
+		e.cost = e.fuzzy.edits * m.penalty
+		return e.fuzzy.edits <= m.maxEdits
+	}
+
+	e.cost = e.fuzzy.bound * m.penalty
+	return true
+
+}
+
+func (m *fuzzyMatcher) matched(e *queueElement) bool {
+	return e.fuzzy.edits <= m.maxEdits
+}
+
+func (m *fuzzyMatcher) spans(e *queueElement, key []byte) []span {
+	if e.fuzzy.end == 0 {
+		return nil
+	}
+	return []span{{0, e.fuzzy.end}}
+}
@@ -0,0 +1,156 @@
+package prefixserver
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// prefixDistance is the smallest edit distance between query and any prefix of key, computed naively.
+func prefixDistance(query, key []byte) int {
+
+	best := len(query) + len(key)
+
+	for end := 0; end <= len(key); end++ {
+
+		prefix := key[:end]
+		row := make([]int, len(prefix)+1)
+		for i := range row {
+			row[i] = i
+		}
+
+		for i := 1; i <= len(query); i++ {
+			diag := row[0]
+			row[0] = i
+			for j := 1; j <= len(prefix); j++ {
+				cost := 1
+				if query[i-1] == prefix[j-1] {
+					cost = 0
+				}
+				next := diag + cost
+				if row[j]+1 < next {
+					next = row[j] + 1
+				}
+				if row[j-1]+1 < next {
+					next = row[j-1] + 1
+				}
+				diag = row[j]
+				row[j] = next
+			}
+		}
+
+		if row[len(prefix)] < best {
+			best = row[len(prefix)]
+		}
+
+	}
+
+	return best
+
+}
+
+func TestFindFuzzyLittle(t *testing.T) {
+
+	index := New()
+	for i, value := range []string{"userName", "usrNum", "username", "getUserName", "other"} {
+		index.Add([]byte(value), []byte(value), i)
+	}
+	index.Compact()
+
+	matches := make([]Match, 10)
+	count := index.FindFuzzy([]byte("usrName"), 2, 100, 0, matches)
+
+	// usrNum has the best score but needs two edits, so it ranks below username
+	expected := []Match{
+		{Value: []byte("userName"), Score: 0, Edits: 1},
+		{Value: []byte("username"), Score: 2, Edits: 2},
+		{Value: []byte("usrNum"), Score: 1, Edits: 2},
+	}
+
+	if count != len(expected) {
+		t.Fatalf("expected %d results, got %d: %+v", len(expected), count, matches[0:count])
+	}
+	for i := range expected {
+		if !bytes.Equal(matches[i].Value, expected[i].Value) || matches[i].Score != expected[i].Score || matches[i].Edits != expected[i].Edits {
+			t.Errorf("expected result %d to be %+v, got %+v", i, expected[i], matches[i])
+		}
+	}
+
+	if count := index.FindFuzzy([]byte("usrName"), 1, 100, 1, matches); count != 0 {
+		t.Errorf("expected no results past the only one within 1 edit, got %+v", matches[0:count])
+	}
+
+	if count := index.FindFuzzy([]byte("usrName"), 0, 100, 0, matches); count != 0 {
+		t.Errorf("expected no results with 0 edits allowed, got %+v", matches[0:count])
+	}
+
+}
+
+func TestFindFuzzy(t *testing.T) {
+
+	const penalty = 300
+
+	index := New()
+	keys := make([][]byte, 2000)
+	scores := make([]int, len(keys))
+	for i := range keys {
+		keys[i] = randBytes()
+		for j := range keys[i] {
+			// a small alphabet makes near misses common
+			keys[i][j] = "abcd"[keys[i][j]%4]
+		}
+		scores[i] = rand.Intn(1000)
+		index.Add(keys[i], keys[i], scores[i])
+	}
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := make([]Match, 20)
+
+	for n := 0; n < 200; n++ {
+
+		query := keys[rand.Intn(len(keys))]
+		query = query[:rand.Intn(len(query))+1]
+		maxEdits := rand.Intn(3)
+
+		// work out the expected ranks by brute force
+		ranks := []int{}
+		for i := range keys {
+			if edits := prefixDistance(query, keys[i]); edits <= maxEdits {
+				ranks = append(ranks, scores[i]-edits*penalty)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(ranks)))
+		if len(ranks) > len(matches) {
+			ranks = ranks[:len(matches)]
+		}
+
+		for _, searcher := range []Searcher{index, mapped} {
+
+			count := searcher.FindFuzzy(query, maxEdits, penalty, 0, matches)
+			if count != len(ranks) {
+				t.Fatalf("%T: for query %s with %d edits: expected %d results, got %d", searcher, query, maxEdits, len(ranks), count)
+			}
+
+			for i := 0; i < count; i++ {
+				if edits := prefixDistance(query, matches[i].Value); matches[i].Edits != edits {
+					t.Fatalf("%T: for query %s: result %s reported %d edits, expected %d", searcher, query, matches[i].Value, matches[i].Edits, edits)
+				}
+				if rank := matches[i].Score - matches[i].Edits*penalty; rank != ranks[i] {
+					t.Fatalf("%T: for query %s with %d edits: result %d (%s) has rank %d, expected %d", searcher, query, maxEdits, i, matches[i].Value, rank, ranks[i])
+				}
+			}
+
+		}
+
+	}
+
+}
@@ -0,0 +1,196 @@
+package prefixserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// An index file may begin with a header recording where it came from and how to check it.
+// The header is the magic bytes, then the length of the header's JSON encoding as
+// a little-endian uint32, then the JSON itself. The body that follows is an index
+// in either the gob or the flat format, exactly as it would be without the header.
+var headerMagic = []byte("PFXINDEX")
+
+// HeaderVersion is the latest version of the header format, which Load can read.
+// Files with a later version are refused by Load. WriteWithHeader writes the earliest version
+// that can read the file correctly, so that older servers can still load files that don't need anything new:
+// version 2 added KeyForm.
+const HeaderVersion = 2
+
+// maxHeaderLen guards against allocating a huge buffer for a corrupt header length.
+const maxHeaderLen = 1 << 20
+
+// crcTable is for the checksum of the body, which is CRC-32C as that's usually computed in hardware.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Header describes an index file: the format of its body, who built it and from what.
+type Header struct {
+	Version int `json:"version"`
+	// Format is the format of the body, "gob" or "flat"
+	Format string `json:"format"`
+	// BodyLength and BodyCRC32C are the length and CRC-32C checksum of the body
+	BodyLength int64  `json:"body_length"`
+	BodyCRC32C uint32 `json:"body_crc32c"`
+
+	// Builder names the program, and its version, that built the index
+	Builder string    `json:"builder,omitempty"`
+	BuiltAt time.Time `json:"built_at"`
+	// SourceSHA256 is the hex-encoded SHA-256 hash of the index source
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+	SourceFormat string `json:"source_format,omitempty"`
+	Tokenizers   string `json:"tokenizers,omitempty"`
+	Entries      int    `json:"entries"`
+
+	// KeyForm is the KeyForm the index's keys are in, as returned by KeyForm.String
+	KeyForm string `json:"key_form,omitempty"`
+	// TieOrder is the TieOrder in which to return matches that rank equally, as returned by TieOrder.String,
+	// or empty for DefaultTieOrder
+	TieOrder string `json:"tie_order,omitempty"`
+}
+
+// WriteWithHeader compacts the index and writes it to w in the flat format if flat is true, or as a gob stream if not,
+// preceded by the header h. The version, format and body fields of the header are filled in by WriteWithHeader.
+// The body is encoded twice, once to checksum it and once to write it, so as not to hold all of it in memory.
+func (in *Index) WriteWithHeader(w io.Writer, h Header, flat bool) error {
+
+	write := func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(in)
+	}
+	h.Format = "gob"
+	if flat {
+		write = in.WriteFlat
+		h.Format = "flat"
+	}
+
+	crc := &crcWriter{}
+	if err := write(crc); err != nil {
+		return err
+	}
+
+	h.Version = 1
+	if h.KeyForm != "" {
+		// older versions would search the index without putting prefixes into its form
+		h.Version = 2
+	}
+	h.BodyLength = crc.n
+	h.BodyCRC32C = crc.sum
+
+	encoded, err := json.Marshal(&h)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, len(headerMagic)+4)
+	copy(prefix, headerMagic)
+	binary.LittleEndian.PutUint32(prefix[len(headerMagic):], uint32(len(encoded)))
+
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return err
+	}
+
+	return write(w)
+
+}
+
+// crcWriter checksums and counts everything written to it.
+type crcWriter struct {
+	sum uint32
+	n   int64
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	c.sum = crc32.Update(c.sum, crcTable, p)
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// hasHeader reports whether data begins with the header's magic bytes.
+func hasHeader(data []byte) bool {
+	return bytes.HasPrefix(data, headerMagic)
+}
+
+// readHeader reads a header from r, which must begin with one, and returns it along with the number of bytes it took up.
+func readHeader(r io.Reader) (*Header, int64, error) {
+
+	prefix := make([]byte, len(headerMagic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, 0, errors.New("index header is truncated")
+	}
+
+	n := binary.LittleEndian.Uint32(prefix[len(headerMagic):])
+	if n > maxHeaderLen {
+		return nil, 0, errors.New("index header is corrupt")
+	}
+
+	encoded := make([]byte, n)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, 0, errors.New("index header is truncated")
+	}
+
+	h := new(Header)
+	if err := json.Unmarshal(encoded, h); err != nil {
+		return nil, 0, fmt.Errorf("index header is corrupt: %s", err)
+	}
+
+	if h.Version > HeaderVersion {
+		return nil, 0, fmt.Errorf("index header is version %d, but only versions up to %d are supported; upgrade to read it", h.Version, HeaderVersion)
+	}
+	if h.Format != "gob" && h.Format != "flat" {
+		return nil, 0, fmt.Errorf("index is in an unknown format %q; upgrade to read it", h.Format)
+	}
+
+	return h, int64(len(prefix)) + int64(n), nil
+
+}
+
+// check verifies that body, read from r, has the length and checksum that the header records for it.
+func (h *Header) check(r io.Reader) error {
+
+	crc := &crcWriter{}
+	if _, err := io.Copy(crc, r); err != nil {
+		return err
+	}
+
+	if crc.n != h.BodyLength {
+		return fmt.Errorf("index is corrupt: its body is %d bytes long, but should be %d", crc.n, h.BodyLength)
+	}
+	if crc.sum != h.BodyCRC32C {
+		return fmt.Errorf("index is corrupt: its body has checksum %08x, but should have %08x", crc.sum, h.BodyCRC32C)
+	}
+
+	return nil
+
+}
+
+// ReadHeader reads the header of the index file at path.
+// It returns a nil Header and no error if the file has none, as is the case for files written before headers existed.
+func ReadHeader(path string) (*Header, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, _ := r.Peek(len(headerMagic))
+	if !hasHeader(magic) {
+		return nil, nil
+	}
+
+	h, _, err := readHeader(r)
+	return h, err
+
+}
@@ -0,0 +1,112 @@
+package prefixserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "prefixserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, keys := makeFakeIndex(1000)
+	builtAt := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, flat := range []bool{false, true} {
+
+		buf := bytes.Buffer{}
+		err := index.WriteWithHeader(&buf, Header{Builder: "test", BuiltAt: builtAt, Tokenizers: "underscore", Entries: 1000}, flat)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, "index")
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, h, err := Load(path)
+		if err != nil {
+			t.Fatalf("flat %v: loading index: %s", flat, err)
+		}
+		if h == nil || h.Version != 1 || h.Builder != "test" || !h.BuiltAt.Equal(builtAt) || h.Tokenizers != "underscore" {
+			t.Errorf("flat %v: unexpected header %+v", flat, h)
+		}
+		if _, isMapped := loaded.(*Mapped); isMapped != flat {
+			t.Errorf("flat %v: loaded as %T", flat, loaded)
+		}
+
+		values := make([][]byte, 1)
+		scores := make([]int, 1)
+		if count := loaded.Find(keys[0], values, scores); count != 1 {
+			t.Errorf("flat %v: on search for %s, expected a result, got none", flat, keys[0])
+		}
+
+		if read, err := ReadHeader(path); err != nil || *read != *h {
+			t.Errorf("flat %v: expected ReadHeader to return %+v, got %+v (err %v)", flat, h, read, err)
+		}
+
+		if err := Verify(path); err != nil {
+			t.Errorf("flat %v: expected the index to verify, got %s", flat, err)
+		}
+
+		// corrupt the last byte of the body, which a flat index is only checked for by Verify,
+		// so as not to read all of it when it's loaded
+		data := buf.Bytes()
+		data[len(data)-1] ^= 0xff
+		ioutil.WriteFile(path, data, 0644)
+		if _, _, err := Load(path); (err == nil) != flat {
+			t.Errorf("flat %v: expected a corrupt index to be loaded only if it's flat, got %v", flat, err)
+		}
+		if err := Verify(path); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("flat %v: expected a corrupt index to be refused, got %v", flat, err)
+		} else if e, ok := err.(*FormatError); !ok || e.Path != path {
+			t.Errorf("flat %v: expected a *FormatError for %s, got %T: %s", flat, path, err, err)
+		}
+
+		// truncate it
+		ioutil.WriteFile(path, data[:len(data)-10], 0644)
+		if _, _, err := Load(path); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("flat %v: expected a truncated index to be refused, got %v", flat, err)
+		}
+		if err := Verify(path); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("flat %v: expected a truncated index to fail verification, got %v", flat, err)
+		}
+
+	}
+
+	// a header from the future
+	buf := bytes.Buffer{}
+	index.WriteWithHeader(&buf, Header{}, false)
+	data := bytes.Replace(buf.Bytes(), []byte(`"version":1`), []byte(`"version":9`), 1)
+	path := filepath.Join(dir, "future.index")
+	ioutil.WriteFile(path, data, 0644)
+	if _, _, err := Load(path); err == nil || !strings.Contains(err.Error(), "version 9") {
+		t.Errorf("expected an index with a later header version to be refused, got %v", err)
+	}
+
+	// a file that isn't an index at all
+	ioutil.WriteFile(path, []byte("foo 1\nbar 2\n"), 0644)
+	if _, _, err := Load(path); err == nil {
+		t.Errorf("expected a text file to be refused")
+	} else if _, ok := err.(*FormatError); !ok {
+		t.Errorf("expected a *FormatError loading a text file, got %T: %s", err, err)
+	}
+
+	// and one that isn't there
+	if _, _, err := Load(filepath.Join(dir, "missing.index")); err == nil {
+		t.Errorf("expected a missing file to be refused")
+	} else if _, ok := err.(*os.PathError); !ok {
+		t.Errorf("expected an *os.PathError loading a missing file, got %T: %s", err, err)
+	}
+
+}
@@ -0,0 +1,105 @@
+package prefixserver
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// A Span locates a part of a match's value that matched the query, as a byte offset and length
+// and as a rune offset and length.
+type Span struct {
+	Offset     int
+	Length     int
+	RuneOffset int
+	RuneLength int
+}
+
+// span is a range of bytes of a key that matched the query.
+type span struct {
+	start, end int
+}
+
+// highlight returns the parts of value that matched the query, given the parts of key, through which it was found, that did.
+// Keys are usually suffixes of their values, perhaps put into f or with their case changed by a tokenizer,
+// but they may also be unrelated, in which case nothing can be highlighted and highlight returns an empty slice.
+func (f KeyForm) highlight(value []byte, key []byte, spans []span) []Span {
+
+	highlights := []Span{}
+	if len(spans) == 0 {
+		return highlights
+	}
+
+	form := f
+	start := form.locate(value, key)
+	if start < 0 {
+		// tokenizers such as camel change the case of the first word of the key
+		form.Fold = FoldUnicode
+		start = form.locate(value, form.Key(key))
+	}
+	if start < 0 {
+		return highlights
+	}
+
+	for _, s := range spans {
+		begin := form.offset(value, start, s.start)
+		end := form.offset(value, start, s.end)
+		highlights = append(highlights, Span{
+			Offset:     begin,
+			Length:     end - begin,
+			RuneOffset: utf8.RuneCount(value[:begin]),
+			RuneLength: utf8.RuneCount(value[begin:end]),
+		})
+	}
+
+	return highlights
+
+}
+
+// locate returns the offset in value of the suffix that f puts into key, or failing that
+// of the first part of value that f puts into something beginning with key, or -1 if there's neither.
+func (f KeyForm) locate(value []byte, key []byte) int {
+
+	first := -1
+
+	for i := 0; i < len(value); {
+
+		suffix := f.Key(value[i:])
+		if bytes.Equal(suffix, key) {
+			return i
+		}
+		if first < 0 && bytes.HasPrefix(suffix, key) {
+			first = i
+		}
+
+		_, size := utf8.DecodeRune(value[i:])
+		i += size
+
+	}
+
+	return first
+
+}
+
+// offset returns the offset in value of byte n of the key that f puts value[start:] into,
+// rounded up to the end of the rune it's in.
+func (f KeyForm) offset(value []byte, start int, n int) int {
+
+	if n == 0 {
+		return start
+	}
+	if f == (KeyForm{}) && start+n <= len(value) {
+		return start + n
+	}
+
+	end := start
+	for end < len(value) {
+		_, size := utf8.DecodeRune(value[end:])
+		end += size
+		if len(f.Key(value[start:end])) >= n {
+			break
+		}
+	}
+
+	return end
+
+}
@@ -2,17 +2,22 @@ package prefixserver
 
 import (
 	"bytes"
-	"container/heap"
 	"container/list"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"unsafe"
 )
 
 type node struct {
 	key      []byte
 	value    []byte
+	payload  []byte
 	score    int
 	children []node
+	// seq is the ID of a leaf's entry, which numbers entries in the order they were added;
+	// the root holds the next ID to hand out
+	seq int
 }
 
 func (n *node) printme(depth int) {
@@ -29,41 +34,123 @@ func (n *node) printme(depth int) {
 	}
 }
 
+// commonPrefixLen returns the length of the longest common prefix of a and b.
+func commonPrefixLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// concatKeys joins two keys into a freshly allocated slice, so that neither
+// argument's backing array is written to.
+func concatKeys(a, b []byte) []byte {
+	key := make([]byte, 0, len(a)+len(b))
+	key = append(key, a...)
+	return append(key, b...)
+}
+
+// split divides n at position pos of its key. n keeps the first pos bytes of the key
+// and gains a single child holding the remainder along with n's former children.
+func (n *node) split(pos int) {
+	child := node{
+		key:      n.key[pos:],
+		score:    n.score,
+		children: n.children,
+	}
+	n.key = n.key[:pos:pos]
+	n.children = []node{child}
+}
+
+// absorbable reports whether n has exactly one child and that child is not a leaf,
+// in which case the two can be merged into a single node.
+func (n *node) absorbable() bool {
+	return len(n.children) == 1 && n.children[0].value == nil
+}
+
+// absorb merges n's only child into n.
+func (n *node) absorb() {
+	n.key = concatKeys(n.key, n.children[0].key)
+	n.children = n.children[0].children
+}
+
+// rescore resets n's score to the maximum score of its children.
+// Leaves and childless nodes are left alone.
+func (n *node) rescore() {
+	if len(n.children) == 0 {
+		return
+	}
+	n.score = n.children[0].score
+	for i := 1; i < len(n.children); i++ {
+		if n.children[i].score > n.score {
+			n.score = n.children[i].score
+		}
+	}
+}
+
 // queue implements a priority queue for traversing nodes best-first.
+// Besides the node itself, each element carries the state of the search
+// along the path that led to it; which fields are used depends on the matcher.
 type queueElement struct {
 	*node
 	prefix []byte
+	// parent is the element of the node's parent, and keyLen the length of the key leading to the node,
+	// not counting the node's own
+	parent *queueElement
+	keyLen int
+
+	// fuzzy tracks a fuzzy search, and cost holds the penalty
+	// by which the node's score is reduced in ranking on account of its edits
+	fuzzy *fuzzyState
+	cost  int
+
+	// abbrev tracks an abbreviation search, whose jumps also count towards cost
+	abbrev *abbrevState
+
+	// pos is the position of the node in a Mapped index
+	pos uint32
 }
 
-type queue []*queueElement
+// Elements of equal rank are ordered by ties.
+type queue struct {
+	elements []*queueElement
+	ties     TieOrder
+}
 
-func new_queue() *queue {
-	rawQ := queue([]*queueElement{})
-	return &rawQ
+func new_queue(ties TieOrder) *queue {
+	if ties == nil {
+		ties = DefaultTieOrder
+	}
+	return &queue{elements: []*queueElement{}, ties: ties}
 }
 
 func (q *queue) Len() int {
-	return len(*q)
+	return len(q.elements)
 }
 
 func (q *queue) Less(i, j int) bool {
-	return (*q)[i].node.score > (*q)[j].node.score
+	a, b := q.elements[i], q.elements[j]
+	if rankA, rankB := a.node.score-a.cost, b.node.score-b.cost; rankA != rankB {
+		return rankA > rankB
+	}
+	return q.ties.less(a, b)
 }
 
 func (q *queue) Swap(i, j int) {
-	tmp := (*q)[i]
-	(*q)[i] = (*q)[j]
-	(*q)[j] = tmp
+	tmp := q.elements[i]
+	q.elements[i] = q.elements[j]
+	q.elements[j] = tmp
 }
 
 func (q *queue) Push(x interface{}) {
-	*q = append(*q, x.(*queueElement))
+	q.elements = append(q.elements, x.(*queueElement))
 }
 
 func (q *queue) Pop() interface{} {
 
-	item := (*q)[len(*q)-1]
-	*q = (*q)[:len(*q)-1]
+	item := q.elements[len(q.elements)-1]
+	q.elements = q.elements[:len(q.elements)-1]
 
 	return item
 
@@ -92,7 +179,8 @@ func (in *Index) dfs(f func(n *node)) {
 
 }
 
-func (in *Index) numNodes() int {
+// Nodes returns the number of nodes in the index's tree, which is a rough measure of its size in memory.
+func (in *Index) Nodes() int {
 	n := 0
 	in.dfs(func(_ *node) {
 		n++
@@ -101,8 +189,92 @@ func (in *Index) numNodes() int {
 	return n
 }
 
+// Footprint returns the approximate number of bytes of memory taken up by the index.
+func (in *Index) Footprint() int {
+	n := 0
+	in.dfs(func(nextNode *node) {
+		n += int(unsafe.Sizeof(*nextNode)) + len(nextNode.key) + len(nextNode.value) + len(nextNode.payload)
+	})
+
+	return n
+}
+
+// Entries returns the number of entries in the index.
+// An entry added under several keys is counted once, however many keys it has.
+func (in *Index) Entries() int {
+	return countEntries((*in)[0].seq, func(f func(id int)) {
+		in.dfs(func(nextNode *node) {
+			if nextNode.value != nil {
+				f(nextNode.seq)
+			}
+		})
+	})
+}
+
+// Keys returns the number of keys entries are filed under in the index, that is, the number of its leaves.
+// An entry added under several keys is counted once for each of them.
+func (in *Index) Keys() int {
+	n := 0
+	in.dfs(func(nextNode *node) {
+		if nextNode.value != nil {
+			n++
+		}
+	})
+
+	return n
+}
+
+// countEntries counts the distinct entry IDs among the leaves passed to f by leaves,
+// out of the ids IDs handed out. A leaf whose ID is out of range is counted on its own.
+func countEntries(ids int, leaves func(f func(id int))) int {
+
+	n := 0
+	seen := make([]uint64, (ids+63)/64)
+	leaves(func(id int) {
+		if id < 0 || id >= ids {
+			n++
+			return
+		}
+		if bit := uint64(1) << (id % 64); seen[id/64]&bit == 0 {
+			seen[id/64] |= bit
+			n++
+		}
+	})
+
+	return n
+
+}
+
 // Add adds an entry to the index with the given value and score.
 func (in *Index) Add(key []byte, value []byte, score int) {
+	in.AddWithPayload(key, value, nil, score)
+}
+
+// AddWithPayload adds an entry to the index with the given value, payload and score.
+// The payload is opaque to the index; searches hand it back alongside the value.
+// Payloads are usually Payloads encoded with MarshalBinary, which Match.Data decodes.
+func (in *Index) AddWithPayload(key []byte, value []byte, payload []byte, score int) {
+	in.AddEntry([][]byte{key}, value, payload, score)
+}
+
+// AddEntry adds an entry to the index under each of keys, with the given value, payload and score, and returns its ID.
+// The entry has the same ID under every key, so a search that reaches it through more than one of them returns it once.
+func (in *Index) AddEntry(keys [][]byte, value []byte, payload []byte, score int) int {
+
+	root := &(*in)[0]
+	id := root.seq
+	root.seq++
+
+	for _, key := range keys {
+		in.add(key, value, payload, score, id)
+	}
+
+	return id
+
+}
+
+// add adds a leaf for the entry with the given ID under key.
+func (in *Index) add(key []byte, value []byte, payload []byte, score int, id int) {
 
 	var attachmentPoint *node = &(*in)[0]
 
@@ -113,20 +285,32 @@ func (in *Index) Add(key []byte, value []byte, score int) {
 		found = false
 		for i := range attachmentPoint.children {
 
-			if attachmentPoint.children[i].value == nil && bytes.HasPrefix(key, attachmentPoint.children[i].key) {
+			child := &attachmentPoint.children[i]
+			if child.value != nil {
+				continue
+			}
 
-				key = key[len(attachmentPoint.children[i].key):]
-				attachmentPoint = &attachmentPoint.children[i]
+			common := commonPrefixLen(key, child.key)
+			if common == 0 {
+				continue
+			}
 
-				if score > attachmentPoint.score {
-					attachmentPoint.score = score
-				}
+			if common < len(child.key) {
+				// the key diverges partway through a compacted node,
+				// so split it at the point of divergence
+				child.split(common)
+			}
 
-				found = true
-				break
+			key = key[common:]
+			attachmentPoint = child
 
+			if score > attachmentPoint.score {
+				attachmentPoint.score = score
 			}
 
+			found = true
+			break
+
 		}
 
 	}
@@ -146,61 +330,239 @@ func (in *Index) Add(key []byte, value []byte, score int) {
 	}
 
 	attachmentPoint.children = append(attachmentPoint.children, node{
-		score: score,
-		value: value,
+		score:   score,
+		value:   value,
+		payload: payload,
+		seq:     id,
 	})
 
 }
 
-// Find locates up to len(values) matches to prefix, stores them in values and their scores in scores, and returns the total number of matches.
-// Find panics if len(values) != len(scores).
-func (in *Index) Find(key []byte, values [][]byte, scores []int) int {
+// path returns the chain of nodes from the root whose keys together spell out key exactly,
+// or nil if key ends partway through a node or isn't in the index.
+func (in *Index) path(key []byte) []*node {
 
-	// initialize the priority queue through which we'll conduct our best-first search
-	q := new_queue()
-	heap.Init(q)
-	heap.Push(q, &queueElement{node: &(*in)[0], prefix: key})
-	matchCount := 0
+	nodes := []*node{&(*in)[0]}
 
-	for q.Len() > 0 {
+	for len(key) > 0 {
 
-		nextStop := heap.Pop(q).(*queueElement)
-		nextNode := nextStop.node
-		prefix := nextStop.prefix
+		parent := nodes[len(nodes)-1]
+		var next *node
 
-		if len(prefix) == 0 || bytes.HasPrefix(prefix, nextNode.key) {
-
-			if len(nextNode.key)-len(prefix) > 0 {
-				prefix = []byte{}
-			} else {
-				prefix = prefix[len(nextNode.key):]
+		for i := range parent.children {
+			child := &parent.children[i]
+			if child.value == nil && len(child.key) > 0 && bytes.HasPrefix(key, child.key) {
+				next = child
+				break
 			}
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		key = key[len(next.key):]
+		nodes = append(nodes, next)
+
+	}
+
+	return nodes
+
+}
+
+// leaf returns the position among n's children of the leaf holding value, or -1 if there is none.
+func (n *node) leaf(value []byte) int {
+	for i := range n.children {
+		if n.children[i].value != nil && bytes.Equal(n.children[i].value, value) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Remove deletes the entry with the given key and value from the index.
+// Nodes left empty by the removal are pruned and straight-line paths are merged back together.
+// Remove returns false if no such entry exists.
+func (in *Index) Remove(key []byte, value []byte) bool {
+
+	nodes := in.path(key)
+	if nodes == nil {
+		return false
+	}
+
+	parent := nodes[len(nodes)-1]
+	pos := parent.leaf(value)
+	if pos == -1 {
+		return false
+	}
+
+	parent.children = append(parent.children[:pos], parent.children[pos+1:]...)
+
+	// walk back up towards the root, pruning nodes that have run out of children
+	for i := len(nodes) - 1; i > 0; i-- {
 
-			for i := range nextNode.children {
-				heap.Push(q, &queueElement{node: &nextNode.children[i], prefix: prefix})
+		n := nodes[i]
+		if len(n.children) > 0 {
+			break
+		}
+
+		grandparent := nodes[i-1]
+		for j := range grandparent.children {
+			if &grandparent.children[j] == n {
+				grandparent.children = append(grandparent.children[:j], grandparent.children[j+1:]...)
+				break
 			}
+		}
+		nodes = nodes[:i]
+
+	}
+
+	// whatever remains at the bottom of the path may now be a redundant link in a chain
+	if last := nodes[len(nodes)-1]; len(nodes) > 1 && last.absorbable() {
+		last.absorb()
+	}
+
+	in.rescore(nodes)
+
+	return true
 
-			if len(prefix) == 0 && nextNode.value != nil {
-				// consumed the whole prefix and this node has a value, so append it
-				values[matchCount] = nextNode.value
-				scores[matchCount] = nextNode.score
-				matchCount++
-				if len(values) == matchCount {
-					// hit the max number of results, so stop early
-					return matchCount
-				}
+}
+
+// UpdateScore changes the score of the entry with the given key and value to score.
+// UpdateScore returns false if no such entry exists.
+func (in *Index) UpdateScore(key []byte, value []byte, score int) bool {
+
+	nodes := in.path(key)
+	if nodes == nil {
+		return false
+	}
+
+	parent := nodes[len(nodes)-1]
+	pos := parent.leaf(value)
+	if pos == -1 {
+		return false
+	}
+
+	parent.children[pos].score = score
+	in.rescore(nodes)
+
+	return true
+
+}
+
+// RemoveEntry deletes the entry with the given ID from the index under every key it was added under,
+// pruning and merging nodes as Remove does. It walks the whole index to find the entry's leaves.
+// RemoveEntry returns false if no such entry exists.
+func (in *Index) RemoveEntry(id int) bool {
+	return (*in)[0].removeEntry(id) > 0
+}
+
+// removeEntry removes the leaves of the entry with the given ID from below n, and returns how many it removed.
+// Children left without children of their own are pruned, and those left as a link in a chain are merged with their only child.
+func (n *node) removeEntry(id int) int {
+
+	removed := 0
+	for i := 0; i < len(n.children); {
+
+		child := &n.children[i]
+		if child.value != nil {
+			if child.seq == id {
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				removed++
+				continue
+			}
+		} else if r := child.removeEntry(id); r > 0 {
+			removed += r
+			if len(child.children) == 0 {
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				continue
 			}
+			if child.absorbable() {
+				child.absorb()
+			}
+		}
+		i++
+
+	}
 
+	if removed > 0 {
+		n.rescore()
+	}
+	return removed
+
+}
+
+// UpdateEntryScore changes the score of the entry with the given ID to score under every key it was added under.
+// It walks the whole index to find the entry's leaves.
+// UpdateEntryScore returns false if no such entry exists.
+func (in *Index) UpdateEntryScore(id int, score int) bool {
+	return (*in)[0].updateEntryScore(id, score)
+}
+
+// updateEntryScore sets the score of the leaves of the entry with the given ID below n, and reports whether there were any.
+func (n *node) updateEntryScore(id int, score int) bool {
+
+	updated := false
+	for i := range n.children {
+		child := &n.children[i]
+		if child.value != nil {
+			if child.seq == id {
+				child.score = score
+				updated = true
+			}
+		} else if child.updateEntryScore(id, score) {
+			updated = true
 		}
+	}
 
+	if updated {
+		n.rescore()
 	}
+	return updated
 
-	return matchCount
+}
 
+// rescore recomputes the maximum descendant scores of the given path, deepest node first.
+func (in *Index) rescore(nodes []*node) {
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i].rescore()
+	}
+}
+
+// Find locates up to len(values) matches to prefix, stores them in values and their scores in scores, and returns the total number of matches.
+// Find panics if len(values) != len(scores).
+func (in *Index) Find(key []byte, values [][]byte, scores []int) int {
+	return in.FindFrom(key, 0, values, scores)
+}
+
+// FindFrom is like Find, but skips over the first offset matches before it starts storing them.
+// Matches are skipped in best-first order, so successive calls with increasing offsets page through the results.
+func (in *Index) FindFrom(key []byte, offset int, values [][]byte, scores []int) int {
+	return search(in, exactMatcher(key), nil, offset, len(values), func(i int, e *queueElement) {
+		values[i] = e.value
+		scores[i] = e.score
+	})
+}
+
+// FindMatches is like FindFrom, but stores its results in matches, payloads and all.
+func (in *Index) FindMatches(key []byte, offset int, matches []Match) int {
+	return search(in, exactMatcher(key), nil, offset, len(matches), func(i int, e *queueElement) {
+		matches[i] = newMatch(e)
+	})
+}
+
+// root and children make Index a tree for search to walk.
+func (in *Index) root() *node {
+	return &(*in)[0]
+}
+
+func (in *Index) children(e *queueElement) ([]node, uint32) {
+	return e.node.children, 0
 }
 
 // Compact reduces the size of the index by merging redundant nodes out of the index.
-// It is an error to call Add after having called Compact.
+// Add, Remove and UpdateScore may still be called afterwards; they split and merge
+// compacted nodes as needed.
 func (in *Index) Compact() {
 
 	// the compacting process condenses nodes on straight-line paths together,
@@ -213,12 +575,9 @@ func (in *Index) Compact() {
 		nextNode := stack[len(stack)-1]
 		stack = stack[:len(stack)-1]
 
-		for len(nextNode.children) == 1 && len(nextNode.children[0].children) > 0 {
-			// absorb the child node
-
-			nextNode.key = append(nextNode.key, nextNode.children[0].key...)
-			nextNode.children = nextNode.children[0].children
-
+		// the root always keeps an empty key so that Add has somewhere to attach
+		for nextNode != &(*in)[0] && nextNode.absorbable() {
+			nextNode.absorb()
 		}
 
 		for i := len(nextNode.children) - 1; i >= 0; i-- {
@@ -232,9 +591,12 @@ func (in *Index) Compact() {
 type nodeGob struct {
 	Keys             [][]byte
 	Values           [][]byte
+	Payloads         [][]byte
 	Scores           []int
 	ChildListIndices []int
 	ChildListLengths []int
+	// Seqs holds each node's seq
+	Seqs []int
 }
 
 // GobEncode implements encoding/gob's GobEncoder interface for serializing the index.
@@ -254,9 +616,11 @@ func (in *Index) GobEncode() ([]byte, error) {
 	g := nodeGob{
 		Keys:             make([][]byte, nodeCount),
 		Values:           make([][]byte, nodeCount),
+		Payloads:         make([][]byte, nodeCount),
 		Scores:           make([]int, nodeCount),
 		ChildListIndices: make([]int, nodeCount),
 		ChildListLengths: make([]int, nodeCount),
+		Seqs:             make([]int, nodeCount),
 	}
 
 	l := list.New()
@@ -273,7 +637,9 @@ func (in *Index) GobEncode() ([]byte, error) {
 		g.ChildListLengths[i] = len(nextNode.children)
 		g.Keys[i] = nextNode.key
 		g.Values[i] = nextNode.value
+		g.Payloads[i] = nextNode.payload
 		g.Scores[i] = nextNode.score
+		g.Seqs[i] = nextNode.seq
 
 		childListPos += len(nextNode.children)
 
@@ -294,6 +660,8 @@ func (in *Index) GobEncode() ([]byte, error) {
 
 }
 
+var errMalformedGob = errors.New("malformed index")
+
 // GobDecode implements encoding/gob's GobDecoder interface for deserializing the index.
 func (in *Index) GobDecode(data []byte) error {
 
@@ -305,15 +673,58 @@ func (in *Index) GobDecode(data []byte) error {
 		return err
 	}
 
-	nodes := make([]node, len(g.Keys))
+	n := len(g.Keys)
+	if n == 0 || len(g.Values) != n || len(g.Scores) != n || len(g.ChildListIndices) != n || len(g.ChildListLengths) != n ||
+		(g.Payloads != nil && len(g.Payloads) != n) || (g.Seqs != nil && len(g.Seqs) != n) {
+		return errMalformedGob
+	}
+
+	for i := range g.ChildListIndices {
+		// children always come after their parent, which also rules out cycles
+		if g.ChildListIndices[i] <= i || g.ChildListLengths[i] < 0 || g.ChildListIndices[i]+g.ChildListLengths[i] > n {
+			if g.ChildListLengths[i] != 0 {
+				return errMalformedGob
+			}
+			g.ChildListIndices[i] = n
+		}
+	}
+
+	nodes := make([]node, n)
+	ids := map[string]int{}
 	for i := range nodes {
 		nodes[i].key = g.Keys[i]
 		nodes[i].value = g.Values[i]
+		if g.Payloads != nil {
+			// indexes encoded before payloads existed have none
+			nodes[i].payload = g.Payloads[i]
+		}
 		nodes[i].score = g.Scores[i]
+		if g.Seqs != nil {
+			nodes[i].seq = g.Seqs[i]
+		} else if nodes[i].value != nil {
+			// indexes encoded before seqs existed didn't record entries' IDs,
+			// so number them in the order they're stored, taking leaves with the same value to be the same entry
+			id, ok := ids[string(g.Values[i])]
+			if !ok {
+				id = nodes[0].seq
+				ids[string(g.Values[i])] = id
+				nodes[0].seq++
+			}
+			nodes[i].seq = id
+		}
 	}
 
 	for i := range nodes {
-		nodes[i].children = nodes[g.ChildListIndices[i] : g.ChildListIndices[i]+g.ChildListLengths[i]]
+		// cap each child list at its own length, so that later Adds reallocate
+		// rather than overwrite the neighbouring child lists
+		end := g.ChildListIndices[i] + g.ChildListLengths[i]
+		nodes[i].children = nodes[g.ChildListIndices[i]:end:end]
+	}
+
+	if len(nodes[0].key) > 0 {
+		// indexes compacted by older versions may have merged a key into the root;
+		// push it down a level so the root is empty again
+		nodes[0] = node{score: nodes[0].score, seq: nodes[0].seq, children: []node{nodes[0]}}
 	}
 
 	*in = nodes[0:1]
@@ -57,7 +57,7 @@ func Test_queue(t *testing.T) {
 			},
 		},
 	}
-	q := new_queue()
+	q := new_queue(nil)
 	heap.Init(q)
 	heap.Push(q, nodes[0])
 	heap.Push(q, nodes[1])
@@ -150,11 +150,11 @@ func TestIndex(t *testing.T) {
 		}
 	}
 
-	sizeBeforeCompacting := index.numNodes()
+	sizeBeforeCompacting := index.Nodes()
 
 	index.Compact()
 
-	t.Logf("size before compacting: %d after compacting: %d", sizeBeforeCompacting, index.numNodes())
+	t.Logf("size before compacting: %d after compacting: %d", sizeBeforeCompacting, index.Nodes())
 
 	for i := range valsStartingWith {
 
@@ -209,15 +209,15 @@ func TestIndexGob(t *testing.T) {
 		count := newIndex.Find(keys[i], outValues, outScores)
 
 		if count != len(expectedValues[i]) {
-			t.Fatalf("on search for key %s, expected %d results, got %s", keys[i], len(expectedValues[i]), count)
+			t.Fatalf("on search for key %s, expected %d results, got %d", keys[i], len(expectedValues[i]), count)
 		}
 		for j := 0; j < count; j++ {
 
 			if string(outValues[j]) != string(expectedValues[i][j]) {
-				t.Errorf("on search for key %s, expected result %d to be %s, got %s", keys[i], expectedValues[i][j], outValues[i])
+				t.Errorf("on search for key %s, expected result %d to be %s, got %s", keys[i], j, expectedValues[i][j], outValues[j])
 			}
 			if outScores[j] != expectedScores[i][j] {
-				t.Errorf("on search for key %s, expected score %d to be %d, got %d", keys[i], expectedScores[i][j], outScores[i])
+				t.Errorf("on search for key %s, expected score %d to be %d, got %d", keys[i], j, expectedScores[i][j], outScores[j])
 			}
 		}
 
@@ -225,6 +225,334 @@ func TestIndexGob(t *testing.T) {
 
 }
 
+func TestIndexGobMalformed(t *testing.T) {
+
+	cases := []nodeGob{
+		{},
+		// a child list running off the end
+		{Keys: [][]byte{{}, []byte("a")}, Values: [][]byte{nil, []byte("a")}, Scores: []int{0, 0},
+			ChildListIndices: []int{1, 2}, ChildListLengths: []int{2, 0}},
+		// a node that is its own child
+		{Keys: [][]byte{{}, []byte("a")}, Values: [][]byte{nil, []byte("a")}, Scores: []int{0, 0},
+			ChildListIndices: []int{1, 1}, ChildListLengths: []int{1, 1}},
+		// mismatched lengths
+		{Keys: [][]byte{{}, []byte("a")}, Values: [][]byte{nil}, Scores: []int{0, 0},
+			ChildListIndices: []int{1, 2}, ChildListLengths: []int{1, 0}},
+	}
+
+	for i, g := range cases {
+
+		buf := bytes.Buffer{}
+		if err := gob.NewEncoder(&buf).Encode(&g); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := New().GobDecode(buf.Bytes()); err == nil {
+			t.Errorf("case %d: expected an error decoding a malformed index", i)
+		}
+
+	}
+
+}
+
+func TestIndexFindFrom(t *testing.T) {
+
+	index, _ := makeFakeIndex(10000)
+	index.Compact()
+
+	allValues := make([][]byte, 1000)
+	allScores := make([]int, 1000)
+	total := index.Find([]byte("a"), allValues, allScores)
+
+	outValues := make([][]byte, 7)
+	outScores := make([]int, 7)
+
+	for offset := 0; offset < total; offset += len(outValues) {
+		count := index.FindFrom([]byte("a"), offset, outValues, outScores)
+		if expected := total - offset; count != len(outValues) && count != expected {
+			t.Fatalf("at offset %d: expected %d results, got %d", offset, expected, count)
+		}
+		for i := 0; i < count; i++ {
+			if string(outValues[i]) != string(allValues[offset+i]) || outScores[i] != allScores[offset+i] {
+				t.Errorf("at offset %d: result %d is %s (%d), expected %s (%d)", offset, i, outValues[i], outScores[i], allValues[offset+i], allScores[offset+i])
+			}
+		}
+	}
+
+	if count := index.FindFrom([]byte("a"), total, outValues, outScores); count != 0 {
+		t.Errorf("expected no results past the end, got %d", count)
+	}
+
+}
+
+func TestIndexAddAfterCompact(t *testing.T) {
+
+	index := New()
+	index.Add([]byte("foobar"), []byte("foobar"), 1)
+	index.Add([]byte("foobaz"), []byte("foobaz"), 2)
+	index.Compact()
+
+	index.Add([]byte("fool"), []byte("fool"), 3)
+	index.Add([]byte("foo"), []byte("foo"), 0)
+
+	outValues := make([][]byte, 10)
+	outScores := make([]int, 10)
+
+	expected := []string{"fool", "foobaz", "foobar", "foo"}
+	for _, prefix := range []string{"", "f", "fo", "foo"} {
+		count := index.Find([]byte(prefix), outValues, outScores)
+		if count != len(expected) {
+			t.Fatalf("for prefix '%s': expected %d results, got %d: %s", prefix, len(expected), count, outValues[0:count])
+		}
+		for i := range expected {
+			if string(outValues[i]) != expected[i] {
+				t.Errorf("for prefix '%s': expected result %d to be %s, got %s", prefix, i, expected[i], outValues[i])
+			}
+		}
+	}
+
+	if count := index.Find([]byte("fooba"), outValues, outScores); count != 2 {
+		t.Errorf("for prefix 'fooba': expected 2 results, got %d: %s", count, outValues[0:count])
+	}
+
+}
+
+func TestIndexRemove(t *testing.T) {
+
+	seen := map[string]bool{}
+	keys := make([][]byte, 10000)
+	index := New()
+	for i := range keys {
+		for keys[i] == nil || seen[string(keys[i])] {
+			keys[i] = randBytes()
+		}
+		seen[string(keys[i])] = true
+		index.Add(keys[i], keys[i], i)
+	}
+	index.Compact()
+	before := index.Nodes()
+
+	outValues := make([][]byte, 10)
+	outScores := make([]int, 10)
+
+	if index.Remove([]byte("not in the index"), []byte("not in the index")) {
+		t.Errorf("Remove reported success for a missing key")
+	}
+	if index.Remove(keys[0], []byte("wrong value")) {
+		t.Errorf("Remove reported success for a missing value")
+	}
+
+	// remove the top-scoring half of the entries
+	for i := len(keys) / 2; i < len(keys); i++ {
+		if !index.Remove(keys[i], keys[i]) {
+			t.Fatalf("failed to remove %s", keys[i])
+		}
+	}
+
+	for i := len(keys) / 2; i < len(keys); i++ {
+		count := index.Find(keys[i], outValues, outScores)
+		for j := 0; j < count; j++ {
+			if outScores[j] >= len(keys)/2 {
+				t.Fatalf("on search for key %s, found removed entry %s (%d)", keys[i], outValues[j], outScores[j])
+			}
+		}
+	}
+
+	for i := 0; i < len(keys)/2; i++ {
+		count := index.Find(keys[i], outValues, outScores)
+		if count == 0 {
+			t.Fatalf("on search for key %s, remaining entry is missing", keys[i])
+		}
+		for j := 1; j < count; j++ {
+			if outScores[j] > outScores[j-1] {
+				t.Fatalf("on search for key %s, results out of order: %d before %d", keys[i], outScores[j-1], outScores[j])
+			}
+		}
+	}
+
+	if (*index)[0].score >= len(keys)/2 {
+		t.Errorf("expected root score to drop below %d, got %d", len(keys)/2, (*index)[0].score)
+	}
+
+	t.Logf("nodes before removal: %d after removal: %d", before, index.Nodes())
+
+	for i := 0; i < len(keys)/2; i++ {
+		index.Remove(keys[i], keys[i])
+	}
+
+	if n := index.Entries(); n != 0 {
+		t.Errorf("expected no entries to remain, got %d", n)
+	}
+
+	if n := index.Nodes(); n != 1 {
+		t.Errorf("expected only the root to remain, got %d nodes", n)
+	}
+
+}
+
+func TestIndexUpdateScore(t *testing.T) {
+
+	index := New()
+	for i, value := range []string{"rA", "rB", "rC", "s"} {
+		index.Add([]byte(value), []byte(value), i)
+	}
+	index.Compact()
+
+	outValues := make([][]byte, 10)
+	outScores := make([]int, 10)
+
+	if !index.UpdateScore([]byte("rA"), []byte("rA"), 10) {
+		t.Fatalf("failed to update score for rA")
+	}
+	if index.UpdateScore([]byte("r"), []byte("rA"), 10) {
+		t.Errorf("UpdateScore reported success for a missing key")
+	}
+
+	count := index.Find([]byte(""), outValues, outScores)
+	if count != 4 || string(outValues[0]) != "rA" || outScores[0] != 10 {
+		t.Fatalf("expected rA to be ranked first with score 10, got %s %d", outValues[0:count], outScores[0:count])
+	}
+
+	index.UpdateScore([]byte("rA"), []byte("rA"), -1)
+	count = index.Find([]byte("r"), outValues, outScores)
+	if count != 3 || string(outValues[0]) != "rC" || string(outValues[2]) != "rA" {
+		t.Errorf("expected rA to be ranked last, got %s", outValues[0:count])
+	}
+
+}
+
+func TestIndexAddEntry(t *testing.T) {
+
+	index := New()
+	index.Add([]byte("foo_a"), []byte("foo_a"), 3)
+	first := index.AddEntry([][]byte{[]byte("foo_a_a"), []byte("a_a"), []byte("a")}, []byte("foo_a_a"), nil, 5)
+	second := index.AddEntry([][]byte{[]byte("a_b"), []byte("b")}, []byte("a_b"), nil, 4)
+	index.Compact()
+
+	if first == second {
+		t.Fatalf("expected entries to have different IDs, both got %d", first)
+	}
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, searcher := range []Searcher{index, mapped} {
+
+		// entries are counted once each, keys once for every key an entry was added under
+		if searcher.Entries() != 3 || searcher.Keys() != 6 {
+			t.Errorf("%T: expected 3 entries under 6 keys, got %d under %d", searcher, searcher.Entries(), searcher.Keys())
+		}
+
+		// foo_a_a is reachable through both a_a and a, but fills only one of the two slots
+		matches := make([]Match, 2)
+		count := searcher.FindMatches([]byte("a"), 0, matches)
+		if count != 2 || string(matches[0].Value) != "foo_a_a" || string(matches[1].Value) != "a_b" {
+			t.Fatalf("%T: expected foo_a_a and a_b, got %d: %+v", searcher, count, matches[:count])
+		}
+		if matches[0].ID != first || string(matches[0].Key) != "a" {
+			t.Errorf("%T: expected foo_a_a to have ID %d and be found through a, got %d and %s", searcher, first, matches[0].ID, matches[0].Key)
+		}
+		if matches[1].ID != second || string(matches[1].Key) != "a_b" {
+			t.Errorf("%T: expected a_b to have ID %d and be found through a_b, got %d and %s", searcher, second, matches[1].ID, matches[1].Key)
+		}
+
+		// paging past it mustn't bring it back
+		if count := searcher.FindMatches([]byte("a"), 1, matches); count != 1 || string(matches[0].Value) != "a_b" {
+			t.Errorf("%T: expected only a_b past the first result, got %+v", searcher, matches[:count])
+		}
+
+	}
+
+	// older indexes have no IDs, so entries with the same value are taken to be the same
+	g := nodeGob{}
+	if err := gob.NewDecoder(bytes.NewReader(mustGobEncode(t, index))).Decode(&g); err != nil {
+		t.Fatal(err)
+	}
+	g.Seqs = nil
+	old := bytes.Buffer{}
+	if err := gob.NewEncoder(&old).Encode(&g); err != nil {
+		t.Fatal(err)
+	}
+	decoded := New()
+	if err := decoded.GobDecode(old.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	matches := make([]Match, 10)
+	if count := decoded.FindMatches([]byte("a"), 0, matches); count != 2 {
+		t.Errorf("expected 2 results from an index without IDs, got %+v", matches[:count])
+	}
+
+}
+
+func TestIndexRemoveEntry(t *testing.T) {
+
+	keys := [][]byte{[]byte("foo_bar"), []byte("bar"), []byte("b")}
+	index := New()
+	id := index.AddEntry(keys, []byte("foo_bar"), nil, 5)
+	other := index.AddEntry([][]byte{[]byte("foo_baz"), []byte("baz")}, []byte("foo_baz"), nil, 3)
+	index.Compact()
+
+	// a new score shows under every key the entry was added under
+	if !index.UpdateEntryScore(id, 1) {
+		t.Fatalf("UpdateEntryScore reported failure for entry %d", id)
+	}
+	matches := make([]Match, 10)
+	for _, key := range [][]byte{[]byte("foo_ba"), []byte("ba")} {
+		count := index.FindMatches(key, 0, matches)
+		if count != 2 || string(matches[0].Value) != "foo_baz" || matches[1].Score != 1 {
+			t.Errorf("on search for %s, expected foo_baz and then foo_bar with score 1, got %+v", key, matches[:count])
+		}
+	}
+	if count := index.FindMatches([]byte("b"), 0, matches); count != 2 || matches[0].Score != 3 {
+		t.Errorf("on search for b, expected foo_baz first with score 3, got %+v", matches[:count])
+	}
+
+	// and removing it removes it from under all of them
+	if !index.RemoveEntry(id) {
+		t.Fatalf("RemoveEntry reported failure for entry %d", id)
+	}
+	for _, key := range keys {
+		for i := 1; i <= len(key); i++ {
+			count := index.FindMatches(key[:i], 0, matches)
+			for _, m := range matches[:count] {
+				if m.ID == id {
+					t.Errorf("on search for %s, expected entry %d to be gone, got %+v", key[:i], id, matches[:count])
+				}
+			}
+		}
+	}
+	if count := index.FindMatches([]byte("b"), 0, matches); count != 1 || matches[0].ID != other {
+		t.Errorf("expected foo_baz to be left, got %+v", matches[:count])
+	}
+	if index.Entries() != 1 || index.Keys() != 2 {
+		t.Errorf("expected 1 entry under 2 keys to be left, got %d under %d", index.Entries(), index.Keys())
+	}
+
+	if index.RemoveEntry(id) || index.UpdateEntryScore(id, 2) {
+		t.Errorf("expected a removed entry to be gone for good")
+	}
+
+	// the remaining entry's paths are merged back together
+	if root := (*index)[0]; len(root.children) != 2 || root.score != 3 {
+		t.Errorf("expected the root to have 2 children with a best score of 3, got %d with %d", len(root.children), root.score)
+	}
+
+}
+
+func mustGobEncode(t *testing.T, in *Index) []byte {
+	data, err := in.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
 // BenchmarkIndexAdd tests the amount of time required to add an item to an index.
 func BenchmarkIndexAdd(b *testing.B) {
 
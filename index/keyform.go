@@ -0,0 +1,235 @@
+package prefixserver
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A KeyForm says how keys are normalized before they're added to an index, and so how prefixes must be normalized
+// before they're searched for, so that a search can match keys that differ from the prefix in case or Unicode form.
+// Values are left alone, so results are displayed as they were given.
+type KeyForm struct {
+	Norm Normalization
+	Fold Folding
+}
+
+// Normalization is the Unicode normalization form a KeyForm puts keys in.
+type Normalization int
+
+const (
+	NormNone Normalization = iota
+	// NormNFC composes characters, so that é matches whether it was given as one code point or two
+	NormNFC
+	// NormNFKC composes characters and replaces compatibility characters, such as ligatures and
+	// full-width letters, with their ordinary equivalents
+	NormNFKC
+)
+
+// Folding is the case folding a KeyForm applies to keys.
+type Folding int
+
+const (
+	FoldNone Folding = iota
+	// FoldASCII folds A-Z to a-z and leaves everything else alone
+	FoldASCII
+	// FoldUnicode folds every letter with Unicode's simple case folding, so that Σ, σ and ς all match
+	FoldUnicode
+)
+
+// ParseKeyForm parses a comma-separated list of the normalizations and folding a KeyForm applies:
+// at most one of nfc and nfkc, and at most one of fold-ascii and fold. The empty string is the identity KeyForm.
+// It accepts anything KeyForm.String returns.
+func ParseKeyForm(s string) (KeyForm, error) {
+
+	var form KeyForm
+	if s == "" {
+		return form, nil
+	}
+
+	for _, name := range strings.Split(s, ",") {
+
+		norm, fold := NormNone, FoldNone
+		switch strings.TrimSpace(name) {
+		case "nfc":
+			norm = NormNFC
+		case "nfkc":
+			norm = NormNFKC
+		case "fold-ascii":
+			fold = FoldASCII
+		case "fold":
+			fold = FoldUnicode
+		default:
+			return KeyForm{}, fmt.Errorf("unknown key form %q", name)
+		}
+
+		if norm != NormNone {
+			if form.Norm != NormNone {
+				return KeyForm{}, fmt.Errorf("key form %q has more than one normalization", s)
+			}
+			form.Norm = norm
+		}
+		if fold != FoldNone {
+			if form.Fold != FoldNone {
+				return KeyForm{}, fmt.Errorf("key form %q has more than one folding", s)
+			}
+			form.Fold = fold
+		}
+
+	}
+
+	return form, nil
+
+}
+
+func (f KeyForm) String() string {
+
+	names := []string{}
+	switch f.Norm {
+	case NormNFC:
+		names = append(names, "nfc")
+	case NormNFKC:
+		names = append(names, "nfkc")
+	}
+	switch f.Fold {
+	case FoldASCII:
+		names = append(names, "fold-ascii")
+	case FoldUnicode:
+		names = append(names, "fold")
+	}
+
+	return strings.Join(names, ",")
+
+}
+
+// Key puts key into the form. It may return key itself if the form leaves it unchanged.
+func (f KeyForm) Key(key []byte) []byte {
+	return f.fold(f.normalize(key))
+}
+
+func (f KeyForm) normalize(key []byte) []byte {
+	switch f.Norm {
+	case NormNFC:
+		return norm.NFC.Bytes(key)
+	case NormNFKC:
+		return norm.NFKC.Bytes(key)
+	}
+	return key
+}
+
+func (f KeyForm) fold(key []byte) []byte {
+
+	switch f.Fold {
+	case FoldASCII:
+		folded := make([]byte, len(key))
+		for i, c := range key {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			folded[i] = c
+		}
+		return folded
+	case FoldUnicode:
+		return bytes.Map(foldRune, key)
+	}
+
+	return key
+
+}
+
+// foldRune maps r to a single representative of the runes that fold together with it,
+// which for cased letters is the lower-case one.
+func foldRune(r rune) rune {
+
+	if r < utf8.RuneSelf {
+		if 'A' <= r && r <= 'Z' {
+			r += 'a' - 'A'
+		}
+		return r
+	}
+
+	// the least rune of the orbit is the same wherever it's entered from
+	least := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < least {
+			least = f
+		}
+	}
+
+	return unicode.ToLower(least)
+
+}
+
+// WithKeyForm returns a Searcher that puts the prefixes it's asked to search for into form before searching s,
+// whose keys must be in that form already. Load does this for index files with a key form in their header.
+func WithKeyForm(s Searcher, form KeyForm) Searcher {
+	if form == (KeyForm{}) {
+		return s
+	}
+	return &formSearcher{Searcher: s, form: form}
+}
+
+type formSearcher struct {
+	Searcher
+	form KeyForm
+}
+
+func (s *formSearcher) Find(key []byte, values [][]byte, scores []int) int {
+	return s.Searcher.Find(s.form.Key(key), values, scores)
+}
+
+func (s *formSearcher) FindFrom(key []byte, offset int, values [][]byte, scores []int) int {
+	return s.Searcher.FindFrom(s.form.Key(key), offset, values, scores)
+}
+
+func (s *formSearcher) FindMatches(key []byte, offset int, matches []Match) int {
+	return s.Searcher.FindMatches(s.form.Key(key), offset, matches)
+}
+
+func (s *formSearcher) FindFuzzy(prefix []byte, maxEdits int, penalty int, offset int, matches []Match) int {
+	return s.Searcher.FindFuzzy(s.form.Key(prefix), maxEdits, penalty, offset, matches)
+}
+
+func (s *formSearcher) FindAbbrev(abbrev []byte, penalty int, offset int, matches []Match) int {
+	// the search needs the form to find where words begin in folded keys
+	return s.Search(&Query{Prefix: abbrev, Abbrev: true, Penalty: penalty}, offset, matches)
+}
+
+func (s *formSearcher) Search(q *Query, offset int, matches []Match) int {
+	formed := *q
+	formed.form = s.form
+	return s.Searcher.Search(&formed, offset, matches)
+}
+
+func (s *formSearcher) Cursor() *Cursor {
+	c := s.Searcher.Cursor()
+	c.form = s.form
+	return c
+}
+
+// caseMatcher ranks values that contain the prefix exactly as it was given, before it was folded,
+// ahead of those that only match once folded, by penalizing the rest.
+type caseMatcher struct {
+	matcher
+	form    KeyForm
+	exact   []byte
+	penalty int
+}
+
+func (m caseMatcher) admit(e *queueElement) bool {
+
+	if !m.matcher.admit(e) {
+		return false
+	}
+
+	// values are only ever found in leaves, so this settles the leaf's rank
+	if e.value != nil && !bytes.Contains(m.form.normalize(e.value), m.exact) {
+		e.cost += m.penalty
+	}
+
+	return true
+
+}
@@ -0,0 +1,125 @@
+package prefixserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseKeyForm(t *testing.T) {
+
+	for _, s := range []string{"", "nfc", "nfkc", "fold-ascii", "fold", "nfc,fold-ascii", "nfkc,fold"} {
+		form, err := ParseKeyForm(s)
+		if err != nil {
+			t.Errorf("parsing %q: %s", s, err)
+			continue
+		}
+		if form.String() != s {
+			t.Errorf("expected %q to parse and print as itself, got %q", s, form.String())
+		}
+	}
+
+	if form, err := ParseKeyForm("fold, nfkc"); err != nil || form != (KeyForm{NormNFKC, FoldUnicode}) {
+		t.Errorf("expected \"fold, nfkc\" to parse as nfkc,fold, got %v (err %v)", form, err)
+	}
+
+	for _, s := range []string{"nfd", "nfc,nfkc", "fold,fold-ascii", "fold,"} {
+		if _, err := ParseKeyForm(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+
+}
+
+func TestKeyFormKey(t *testing.T) {
+
+	cases := []struct {
+		form KeyForm
+		a, b string
+		same bool
+	}{
+		{KeyForm{}, "User", "user", false},
+		{KeyForm{Fold: FoldASCII}, "UserName", "username", true},
+		{KeyForm{Fold: FoldASCII}, "ΣΊΣΥΦΟΣ", "σίσυφος", false},
+		{KeyForm{Fold: FoldUnicode}, "ΣΊΣΥΦΟΣ", "σίσυφοσ", true},
+		{KeyForm{Fold: FoldUnicode}, "σίσυφος", "σίσυφοσ", true},
+		// the Kelvin sign folds with K and k
+		{KeyForm{Fold: FoldUnicode}, "\u212aelvin", "kelvin", true},
+		// é composed and decomposed
+		{KeyForm{}, "caf\u00e9", "cafe\u0301", false},
+		{KeyForm{Norm: NormNFC}, "caf\u00e9", "cafe\u0301", true},
+		{KeyForm{Norm: NormNFC}, "\ufb01le", "file", false},
+		{KeyForm{Norm: NormNFKC}, "\ufb01le", "file", true},
+		{KeyForm{Norm: NormNFKC, Fold: FoldUnicode}, "ＣＡＦＥ\u0301", "caf\u00e9", true},
+	}
+
+	for _, c := range cases {
+		a, b := c.form.Key([]byte(c.a)), c.form.Key([]byte(c.b))
+		if bytes.Equal(a, b) != c.same {
+			t.Errorf("%q: expected %q and %q to be the same: %v, got %q and %q", c.form, c.a, c.b, c.same, a, b)
+		}
+	}
+
+}
+
+func TestWithKeyForm(t *testing.T) {
+
+	form := KeyForm{Norm: NormNFC, Fold: FoldUnicode}
+
+	index := New()
+	for _, value := range []string{"username", "UserName", "USERNAME", "userNumber", "caf\u00e9"} {
+		index.Add(form.Key([]byte(value)), []byte(value), 10)
+	}
+	index.Compact()
+
+	dir, err := ioutil.TempDir("", "keyform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	buf := bytes.Buffer{}
+	if err := index.WriteWithHeader(&buf, Header{KeyForm: form.String()}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, h, err := Load(path)
+	if err != nil {
+		t.Fatalf("loading index: %s", err)
+	}
+	if h.Version != 2 {
+		t.Errorf("expected a header of version 2 for an index with a key form, got %d", h.Version)
+	}
+
+	for _, s := range []Searcher{WithKeyForm(index, form), loaded} {
+
+		matches := make([]Match, 10)
+
+		if count := s.FindMatches([]byte("USERN"), 0, matches); count != 4 {
+			t.Errorf("%T: expected USERN to match 4 entries, got %d: %v", s, count, matches[:count])
+		}
+		if count := s.FindMatches([]byte("CAFE\u0301"), 0, matches); count != 1 {
+			t.Errorf("%T: expected a decomposed CAFÉ to match café, got %d results", s, count)
+		}
+
+		// with every score equal, the entry in the exact case must be boosted to the top, by the cursor too
+		for _, searcher := range []interface {
+			Search(q *Query, offset int, matches []Match) int
+		}{s, s.Cursor()} {
+			for _, prefix := range []string{"UserN", "USERN", "usern"} {
+				count := searcher.Search(&Query{Prefix: []byte(prefix), CaseBoost: 1}, 0, matches)
+				if count != 4 || !bytes.HasPrefix(matches[0].Value, []byte(prefix)) {
+					t.Errorf("%T: on search for %s, expected 4 results with an exact match first, got %d: %v", searcher, prefix, count, matches[:count])
+				}
+			}
+		}
+
+	}
+
+}
@@ -0,0 +1,157 @@
+package prefixserver
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Searcher is implemented by both *Index and *Mapped, so that callers can search
+// an index without caring which format it was loaded from.
+type Searcher interface {
+	Find(key []byte, values [][]byte, scores []int) int
+	FindFrom(key []byte, offset int, values [][]byte, scores []int) int
+	FindMatches(key []byte, offset int, matches []Match) int
+	FindFuzzy(prefix []byte, maxEdits int, penalty int, offset int, matches []Match) int
+	FindAbbrev(abbrev []byte, penalty int, offset int, matches []Match) int
+	Search(q *Query, offset int, matches []Match) int
+	Cursor() *Cursor
+	Entries() int
+	Keys() int
+	Nodes() int
+	Footprint() int
+}
+
+// Load reads the index file at path, which may be in either the gob or the flat format.
+// Flat indexes are memory-mapped with Open; gob indexes are decoded into an Index.
+// If the file has a header, Load returns it too, having checked that the file matches it,
+// and the Searcher it returns puts prefixes into the key form the header records and breaks ties in its tie order.
+// A gob index's body is checked against the checksum in its header before it's decoded, but a flat index's only
+// against its length, so that loading one doesn't read all of it; use Verify to check the whole file.
+// Files written before headers existed have none, and are loaded without any checks.
+//
+// If the file can't be read, the error is an *os.PathError; if it isn't a valid index, the error is a *FormatError.
+func Load(path string) (Searcher, *Header, error) {
+
+	in, h, err := load(path)
+	if err == nil && h != nil {
+		var form KeyForm
+		var ties TieOrder
+		if form, err = ParseKeyForm(h.KeyForm); err == nil {
+			in = WithKeyForm(in, form)
+		}
+		if err == nil && h.TieOrder != "" {
+			if ties, err = ParseTieOrder(h.TieOrder); err == nil {
+				in = WithTieOrder(in, ties)
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, formatError(path, err)
+	}
+
+	return in, h, nil
+
+}
+
+// Verify reads the whole of the index file at path and checks it as thoroughly as it can: its body against
+// the checksum in its header, if it has one, and for the flat format every node record against the bounds of the file.
+// Its errors are those of Load.
+func Verify(path string) error {
+
+	in, _, err := load(path)
+	if err != nil {
+		return formatError(path, err)
+	}
+
+	if m, ok := in.(*Mapped); ok {
+		defer m.Close()
+		if err := m.Verify(); err != nil {
+			return &FormatError{Path: path, Err: err}
+		}
+	}
+
+	return nil
+
+}
+
+// formatError returns err, which loading the index file at path failed with, as a *FormatError,
+// unless it's already one or is an *os.PathError.
+func formatError(path string, err error) error {
+	switch err.(type) {
+	case *os.PathError, *FormatError:
+		return err
+	}
+	return &FormatError{Path: path, Err: err}
+}
+
+// FormatError records a file that couldn't be loaded because it isn't a valid index:
+// it's corrupt, in an unknown format, or from a newer version.
+type FormatError struct {
+	Path string
+	Err  error
+}
+
+func (e *FormatError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func load(path string) (Searcher, *Header, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, _ := r.Peek(len(headerMagic))
+
+	if IsFlat(magic) {
+		m, err := Open(path)
+		return m, nil, err
+	} else if !hasHeader(magic) {
+		in, err := decodeGob(r)
+		return in, nil, err
+	}
+
+	h, offset, err := readHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.Format == "flat" {
+		// Open checks the header itself, against the mapped file
+		m, err := Open(path)
+		return m, h, err
+	}
+
+	// check the whole body before decoding any of it, since gob is none too careful with corrupt input
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	if err := h.check(file); err != nil {
+		return nil, nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	in, err := decodeGob(bufio.NewReader(file))
+	return in, h, err
+
+}
+
+func decodeGob(r io.Reader) (*Index, error) {
+
+	in := New()
+	dec := gob.NewDecoder(r)
+	if err := dec.Decode(in); err != nil {
+		return nil, fmt.Errorf("decoding index: %s", err)
+	}
+
+	return in, nil
+
+}
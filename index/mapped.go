@@ -0,0 +1,433 @@
+package prefixserver
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// The flat index format lays the compacted trie out as fixed-size node records
+// followed by the bytes of every key, value and payload, so that it can be searched
+// in place without decoding. All integers are little-endian.
+//
+//	magic      [8]byte  "PFXFLAT2"
+//	nodeCount  uint64
+//	dataLen    uint64
+//	nodes      [nodeCount]record
+//	data       [dataLen]byte
+//
+// Each record is
+//
+//	score      int64
+//	dataOff    uint64   offset into data of the key, which the value and then the payload directly follow
+//	keyLen     uint32
+//	valueLen   uint32   noValue for nodes that aren't leaves
+//	payloadLen uint32
+//	firstChild uint32   position of the first child in nodes
+//	childCount uint32
+//	seq        uint32   the ID of a leaf's entry, and for the root the number of IDs handed out
+//
+// Nodes are stored breadth-first, so each node's children are contiguous.
+// Files written before IDs were recorded have zero in their place.
+//
+// The final byte of the magic is the format version.
+var flatMagic = []byte("PFXFLAT2")
+
+const (
+	flatHeaderLen = 24
+	flatRecordLen = 40
+	noValue       = 1<<32 - 1
+)
+
+// WriteFlat compacts the index and writes it to w in the flat format read by Open and NewMapped.
+func (in *Index) WriteFlat(w io.Writer) error {
+
+	in.Compact()
+
+	nodeCount := 0
+	dataLen := 0
+	in.dfs(func(n *node) {
+		nodeCount++
+		dataLen += len(n.key) + len(n.value) + len(n.payload)
+	})
+
+	if nodeCount >= noValue {
+		return fmt.Errorf("index has too many nodes (%d) for the flat format", nodeCount)
+	}
+
+	bw := bufio.NewWriter(w)
+
+	header := make([]byte, flatHeaderLen)
+	copy(header, flatMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(nodeCount))
+	binary.LittleEndian.PutUint64(header[16:], uint64(dataLen))
+	bw.Write(header)
+
+	// lay out the node records breadth-first, as GobEncode does
+	l := list.New()
+	l.PushFront(&(*in)[0])
+
+	record := make([]byte, flatRecordLen)
+	childListPos := 1
+	dataOff := 0
+
+	for l.Len() > 0 {
+
+		nextNode := l.Remove(l.Front()).(*node)
+
+		valueLen := uint32(noValue)
+		if nextNode.value != nil {
+			valueLen = uint32(len(nextNode.value))
+		}
+
+		binary.LittleEndian.PutUint64(record[0:], uint64(int64(nextNode.score)))
+		binary.LittleEndian.PutUint64(record[8:], uint64(dataOff))
+		binary.LittleEndian.PutUint32(record[16:], uint32(len(nextNode.key)))
+		binary.LittleEndian.PutUint32(record[20:], valueLen)
+		binary.LittleEndian.PutUint32(record[24:], uint32(len(nextNode.payload)))
+		binary.LittleEndian.PutUint32(record[28:], uint32(childListPos))
+		binary.LittleEndian.PutUint32(record[32:], uint32(len(nextNode.children)))
+		binary.LittleEndian.PutUint32(record[36:], uint32(nextNode.seq))
+		bw.Write(record)
+
+		dataOff += len(nextNode.key) + len(nextNode.value) + len(nextNode.payload)
+		childListPos += len(nextNode.children)
+
+		for j := range nextNode.children {
+			l.PushBack(&nextNode.children[j])
+		}
+
+	}
+
+	// the data section follows the same order as the records
+	l.PushFront(&(*in)[0])
+
+	for l.Len() > 0 {
+
+		nextNode := l.Remove(l.Front()).(*node)
+		bw.Write(nextNode.key)
+		bw.Write(nextNode.value)
+		bw.Write(nextNode.payload)
+
+		for j := range nextNode.children {
+			l.PushBack(&nextNode.children[j])
+		}
+
+	}
+
+	return bw.Flush()
+
+}
+
+// IsFlat reports whether data begins with the flat index format's magic bytes, of any version.
+func IsFlat(data []byte) bool {
+	return bytes.HasPrefix(data, flatMagic[:len(flatMagic)-1])
+}
+
+// Mapped is a read-only index searched in place from a buffer in the flat format,
+// usually a memory-mapped file opened with Open.
+// Values returned by its searches point into that buffer rather than being copied out of it,
+// so they are only valid until the index is closed.
+type Mapped struct {
+	nodes []byte
+	data  []byte
+	count int
+	unmap func() error
+
+	// header is the header data began with, if it had one, and body the rest of data, for Verify to check
+	header *Header
+	body   []byte
+}
+
+var errFlatTruncated = errors.New("flat index is truncated")
+
+// NewMapped returns an index that searches data, which must hold an index in the flat format.
+// It checks only the format's header and that data is as long as the header says, so that opening an index
+// doesn't read all of it; Verify checks the rest. A search that comes across a corrupt node record treats it
+// as an empty node rather than running off the end of data. data must not be modified while the index is in use.
+func NewMapped(data []byte) (*Mapped, error) {
+
+	if len(data) < flatHeaderLen || !IsFlat(data) {
+		return nil, errors.New("not a flat index")
+	}
+
+	if version := data[len(flatMagic)-1]; version != flatMagic[len(flatMagic)-1] {
+		return nil, fmt.Errorf("flat index is format version %c, but only version %c is supported; rebuild it", version, flatMagic[len(flatMagic)-1])
+	}
+
+	nodeCount := binary.LittleEndian.Uint64(data[8:])
+	dataLen := binary.LittleEndian.Uint64(data[16:])
+
+	if nodeCount == 0 || nodeCount >= noValue {
+		return nil, fmt.Errorf("flat index has an invalid node count (%d)", nodeCount)
+	}
+
+	nodesEnd := flatHeaderLen + nodeCount*flatRecordLen
+	if nodesEnd+dataLen != uint64(len(data)) {
+		return nil, errFlatTruncated
+	}
+
+	return &Mapped{
+		nodes: data[flatHeaderLen:nodesEnd],
+		data:  data[nodesEnd:],
+		count: int(nodeCount),
+		body:  data,
+	}, nil
+
+}
+
+// Verify reads the whole index, checking its body against the checksum in its header, if it was opened with one,
+// and every node record against the bounds of the data, so that a corrupt index can be refused before it's put into service.
+func (m *Mapped) Verify() error {
+
+	if m.header != nil {
+		if err := m.header.check(bytes.NewReader(m.body)); err != nil {
+			return err
+		}
+	}
+
+	for i := uint32(0); i < uint32(m.count); i++ {
+		if err := m.checkRecord(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// checkRecord makes sure that node n's key, value and payload lie within the data,
+// and that its children lie within the nodes, after it, so that searches can't run off the end of either or loop.
+func (m *Mapped) checkRecord(n uint32) error {
+
+	r := m.record(n)
+	off := binary.LittleEndian.Uint64(r[8:])
+	end := uint64(binary.LittleEndian.Uint32(r[16:]))
+	if valueLen := binary.LittleEndian.Uint32(r[20:]); valueLen != noValue {
+		end += uint64(valueLen) + uint64(binary.LittleEndian.Uint32(r[24:]))
+	}
+	if off > uint64(len(m.data)) || end > uint64(len(m.data))-off {
+		return fmt.Errorf("flat index node %d lies outside the data", n)
+	}
+
+	first, count := m.childList(n)
+	if count > 0 && (first <= n || uint64(first)+uint64(count) > uint64(m.count)) {
+		return fmt.Errorf("flat index node %d has children outside the nodes", n)
+	}
+
+	return nil
+
+}
+
+// newMappedWithHeader is NewMapped for data that may begin with a header.
+// It checks that the rest of data is as long as the header says, leaving its checksum to Verify.
+func newMappedWithHeader(data []byte) (*Mapped, error) {
+
+	if !hasHeader(data) {
+		return NewMapped(data)
+	}
+
+	h, n, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if h.Format != "flat" {
+		return nil, errors.New("not a flat index")
+	}
+
+	body := data[n:]
+	if int64(len(body)) != h.BodyLength {
+		return nil, fmt.Errorf("index is corrupt: its body is %d bytes long, but should be %d", len(body), h.BodyLength)
+	}
+
+	m, err := NewMapped(body)
+	if err != nil {
+		return nil, err
+	}
+	m.header = h
+
+	return m, nil
+
+}
+
+// Open memory-maps the flat index file at path, which may begin with a header.
+// The mapping is released by Close, or once the index becomes unreachable.
+// If the file can't be read, the error is an *os.PathError; if it isn't a valid flat index, the error is a *FormatError.
+//
+// The mapping is shared with the file, so the file must not be written to while it's open:
+// that can tear the results of searches, or crash the process with SIGBUS if the file shrinks.
+// Replace an index file by writing a new one alongside it and renaming it over the old one,
+// which leaves the old one mapped until it's closed.
+func Open(path string) (*Mapped, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, unmap, err := mmap(file)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: path, Err: err}
+	}
+
+	m, err := newMappedWithHeader(data)
+	if err != nil {
+		unmap()
+		return nil, &FormatError{Path: path, Err: err}
+	}
+
+	m.unmap = unmap
+	runtime.SetFinalizer(m, (*Mapped).Close)
+
+	return m, nil
+
+}
+
+// Close releases the file mapping behind the index, if there is one.
+// Values previously returned by its searches must not be used afterwards.
+func (m *Mapped) Close() error {
+
+	if m.unmap == nil {
+		return nil
+	}
+
+	err := m.unmap()
+	m.unmap = nil
+	m.nodes = nil
+	m.data = nil
+	m.body = nil
+	runtime.SetFinalizer(m, nil)
+
+	return err
+
+}
+
+// Entries returns the number of entries in the index, as Index.Entries does.
+// It reads every node record to count them.
+func (m *Mapped) Entries() int {
+	return countEntries(int(binary.LittleEndian.Uint32(m.record(0)[36:])), func(f func(id int)) {
+		for i := 0; i < m.count; i++ {
+			if record := m.record(uint32(i)); binary.LittleEndian.Uint32(record[20:]) != noValue {
+				f(int(binary.LittleEndian.Uint32(record[36:])))
+			}
+		}
+	})
+}
+
+// Keys returns the number of keys entries are filed under in the index, as Index.Keys does.
+// It reads every node record to count them.
+func (m *Mapped) Keys() int {
+	n := 0
+	for i := 0; i < m.count; i++ {
+		if binary.LittleEndian.Uint32(m.record(uint32(i))[20:]) != noValue {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Nodes returns the number of nodes in the index's tree.
+func (m *Mapped) Nodes() int {
+	return m.count
+}
+
+// Footprint returns the number of bytes of the index, which are mapped from its file
+// rather than allocated if it was opened with Open.
+func (m *Mapped) Footprint() int {
+	return flatHeaderLen + len(m.nodes) + len(m.data)
+}
+
+func (m *Mapped) record(n uint32) []byte {
+	off := uint64(n) * flatRecordLen
+	return m.nodes[off : off+flatRecordLen]
+}
+
+// node returns a copy of node n. Its key, value and payload point into the index's buffer;
+// its children are left for the children method to fill in when needed.
+// A corrupt record comes back as an empty node, without a key, a value or children.
+func (m *Mapped) node(n uint32) node {
+
+	if m.checkRecord(n) != nil {
+		return node{}
+	}
+
+	r := m.record(n)
+	off := binary.LittleEndian.Uint64(r[8:])
+	keyLen := uint64(binary.LittleEndian.Uint32(r[16:]))
+	valueLen := binary.LittleEndian.Uint32(r[20:])
+
+	keyEnd := off + keyLen
+	nextNode := node{
+		key:   m.data[off:keyEnd:keyEnd],
+		score: int(int64(binary.LittleEndian.Uint64(r))),
+		seq:   int(binary.LittleEndian.Uint32(r[36:])),
+	}
+
+	if valueLen != noValue {
+		valueEnd := keyEnd + uint64(valueLen)
+		payloadEnd := valueEnd + uint64(binary.LittleEndian.Uint32(r[24:]))
+		nextNode.value = m.data[keyEnd:valueEnd:valueEnd]
+		if payloadEnd > valueEnd {
+			nextNode.payload = m.data[valueEnd:payloadEnd:payloadEnd]
+		}
+	}
+
+	return nextNode
+
+}
+
+// childList returns the position of node n's first child and the number of children it has.
+func (m *Mapped) childList(n uint32) (uint32, uint32) {
+	r := m.record(n)
+	return binary.LittleEndian.Uint32(r[28:]), binary.LittleEndian.Uint32(r[32:])
+}
+
+// root and children make Mapped a tree for search to walk.
+func (m *Mapped) root() *node {
+	root := m.node(0)
+	return &root
+}
+
+func (m *Mapped) children(e *queueElement) ([]node, uint32) {
+
+	first, count := m.childList(e.pos)
+	if count == 0 || m.checkRecord(e.pos) != nil {
+		return nil, first
+	}
+
+	children := make([]node, count)
+	for i := range children {
+		children[i] = m.node(first + uint32(i))
+	}
+
+	return children, first
+
+}
+
+// Find locates up to len(values) matches to prefix, as Index.Find does.
+func (m *Mapped) Find(key []byte, values [][]byte, scores []int) int {
+	return m.FindFrom(key, 0, values, scores)
+}
+
+// FindFrom skips over the first offset matches to prefix and then locates up to len(values) more, as Index.FindFrom does.
+func (m *Mapped) FindFrom(key []byte, offset int, values [][]byte, scores []int) int {
+	return search(m, exactMatcher(key), nil, offset, len(values), func(i int, e *queueElement) {
+		values[i] = e.value
+		scores[i] = e.score
+	})
+}
+
+// FindMatches skips over the first offset matches to prefix and then locates up to len(matches) more, as Index.FindMatches does.
+func (m *Mapped) FindMatches(key []byte, offset int, matches []Match) int {
+	return search(m, exactMatcher(key), nil, offset, len(matches), func(i int, e *queueElement) {
+		matches[i] = newMatch(e)
+	})
+}
@@ -0,0 +1,251 @@
+package prefixserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMappedFind(t *testing.T) {
+
+	index, keys := makeFakeIndex(100000)
+	index.Add([]byte("empty"), []byte{}, -5)
+	index.AddWithPayload([]byte("payload"), []byte("withPayload"), []byte("data"), -6)
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatalf("writing flat index: %s", err)
+	}
+
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading flat index: %s", err)
+	}
+
+	if mapped.Nodes() != index.Nodes() {
+		t.Errorf("expected %d nodes, got %d", index.Nodes(), mapped.Nodes())
+	}
+	if mapped.Footprint() != buf.Len() {
+		t.Errorf("expected a footprint of %d bytes, got %d", buf.Len(), mapped.Footprint())
+	}
+
+	outValues := make([][]byte, 10)
+	outScores := make([]int, 10)
+	mappedValues := make([][]byte, 10)
+	mappedScores := make([]int, 10)
+
+	for i := 0; i < len(keys); i += 97 {
+		for _, prefix := range [][]byte{keys[i], keys[i][:1], {}} {
+
+			count := index.FindFrom(prefix, i%3, outValues, outScores)
+			mappedCount := mapped.FindFrom(prefix, i%3, mappedValues, mappedScores)
+
+			if count != mappedCount {
+				t.Fatalf("on search for %s, expected %d results, got %d", prefix, count, mappedCount)
+			}
+			for j := 0; j < count; j++ {
+				if !bytes.Equal(outValues[j], mappedValues[j]) || outScores[j] != mappedScores[j] {
+					t.Fatalf("on search for %s, expected result %d to be %s (%d), got %s (%d)", prefix, j, outValues[j], outScores[j], mappedValues[j], mappedScores[j])
+				}
+			}
+
+		}
+	}
+
+	if mapped.Entries() != index.Entries() {
+		t.Errorf("expected %d entries, got %d", index.Entries(), mapped.Entries())
+	}
+
+	count := mapped.Find([]byte("empty"), mappedValues, mappedScores)
+	if count != 1 || mappedValues[0] == nil || len(mappedValues[0]) != 0 || mappedScores[0] != -5 {
+		t.Errorf("expected an empty, non-nil value with score -5, got %d results: %q %d", count, mappedValues[0:count], mappedScores[0:count])
+	}
+
+	matches := make([]Match, 2)
+	count = mapped.FindMatches([]byte("payload"), 0, matches)
+	if count != 1 || string(matches[0].Value) != "withPayload" || string(matches[0].Payload) != "data" || matches[0].Score != -6 {
+		t.Errorf("expected withPayload with its payload, got %d results: %+v", count, matches[0:count])
+	}
+
+	if _, err := NewMapped(buf.Bytes()[:buf.Len()-1]); err == nil {
+		t.Errorf("expected an error for a truncated flat index")
+	}
+
+}
+
+func TestLoad(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "prefixserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, keys := makeFakeIndex(1000)
+	index.AddWithPayload([]byte("payload"), []byte("withPayload"), []byte("data"), 0)
+
+	flatFile, err := os.Create(filepath.Join(dir, "flat.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.WriteFlat(flatFile); err != nil {
+		t.Fatal(err)
+	}
+	flatFile.Close()
+
+	loaded, header, err := Load(flatFile.Name())
+	if err != nil {
+		t.Fatalf("loading flat index: %s", err)
+	}
+
+	mapped, ok := loaded.(*Mapped)
+	if !ok {
+		t.Fatalf("expected a flat index to load as *Mapped, got %T", loaded)
+	}
+	if header != nil {
+		t.Errorf("expected no header, got %+v", header)
+	}
+
+	outValues := make([][]byte, 1)
+	outScores := make([]int, 1)
+	if count := mapped.Find(keys[0], outValues, outScores); count != 1 {
+		t.Errorf("on search for %s, expected a result, got none", keys[0])
+	}
+
+	if err := mapped.Close(); err != nil {
+		t.Errorf("closing mapped index: %s", err)
+	}
+
+	gobFile := filepath.Join(dir, "gob.index")
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(index); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(gobFile, buf.Bytes(), 0644)
+
+	if loaded, _, err = Load(gobFile); err != nil {
+		t.Fatalf("loading gob index: %s", err)
+	} else if _, ok := loaded.(*Index); !ok {
+		t.Fatalf("expected a gob index to load as *Index, got %T", loaded)
+	}
+
+	matches := make([]Match, 1)
+	if count := loaded.FindMatches([]byte("payload"), 0, matches); count != 1 || string(matches[0].Payload) != "data" {
+		t.Errorf("expected the payload to survive gob encoding, got %d results: %+v", count, matches[0:count])
+	}
+
+}
+
+func TestMappedCorrupt(t *testing.T) {
+
+	index, _ := makeFakeIndex(100)
+	index.AddWithPayload([]byte("payload"), []byte("withPayload"), []byte("data"), 0)
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	flat := buf.Bytes()
+	count := index.Nodes()
+
+	// every field of every record that locates something must be checked when the index is opened
+	fields := []struct {
+		name  string
+		off   int
+		value uint64
+	}{
+		{"dataOff", 8, 1 << 63},
+		{"keyLen", 16, 1<<32 - 2},
+		{"valueLen", 20, 1<<32 - 2},
+		{"firstChild", 28, uint64(count)},
+		{"childCount", 32, uint64(count)},
+	}
+
+	for n := 0; n < count; n++ {
+		for _, f := range fields {
+
+			corrupt := append([]byte{}, flat...)
+			at := flatHeaderLen + n*flatRecordLen + f.off
+			if f.off == 8 {
+				binary.LittleEndian.PutUint64(corrupt[at:], f.value)
+			} else {
+				binary.LittleEndian.PutUint32(corrupt[at:], uint32(f.value))
+			}
+
+			if f.name == "firstChild" && binary.LittleEndian.Uint32(flat[at+4:]) == 0 {
+				// the first child of a leaf is never used
+				continue
+			}
+
+			mapped, err := NewMapped(corrupt)
+			if err != nil {
+				t.Fatalf("expected node %d with a bad %s to be found only by Verify, got %s", n, f.name, err)
+			}
+			if err := mapped.Verify(); err == nil {
+				t.Fatalf("expected an error for node %d with a bad %s", n, f.name)
+			}
+
+		}
+	}
+
+	// a node whose children include itself would send searches round in circles
+	cyclic := append([]byte{}, flat...)
+	binary.LittleEndian.PutUint32(cyclic[flatHeaderLen+28:], 0)
+	mapped, err := NewMapped(cyclic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mapped.Verify(); err == nil {
+		t.Errorf("expected an error for a root that's its own child")
+	}
+	if count := mapped.FindMatches(nil, 0, make([]Match, 10)); count != 0 {
+		t.Errorf("expected a root that's its own child to be taken as empty, got %d results", count)
+	}
+
+	// whatever garbage the records hold, the index must be searchable
+	r := rand.New(rand.NewSource(1))
+	matches := make([]Match, 10)
+	for i := 0; i < 2000; i++ {
+
+		corrupt := append([]byte{}, flat...)
+		for j := 0; j < 4; j++ {
+			corrupt[flatHeaderLen+r.Intn(count*flatRecordLen)] = byte(r.Intn(256))
+		}
+
+		mapped, err := NewMapped(corrupt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, prefix := range []string{"", "a", "payload"} {
+			mapped.FindMatches([]byte(prefix), 0, matches)
+			mapped.FindFuzzy([]byte(prefix), 1, 1, 0, matches)
+		}
+		mapped.Entries()
+
+	}
+
+	dir, err := ioutil.TempDir("", "prefixserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "corrupt.index")
+	if err := ioutil.WriteFile(path, cyclic, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err != nil {
+		t.Errorf("expected a corrupt index to open, got %s", err)
+	}
+	if err := Verify(path); err == nil {
+		t.Errorf("expected an error verifying a corrupt index")
+	} else if e, ok := err.(*FormatError); !ok || e.Path != path {
+		t.Errorf("expected a *FormatError for %s verifying a corrupt index, got %T: %s", path, err, err)
+	}
+
+}
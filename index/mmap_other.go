@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package prefixserver
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mmap reads the whole of file into memory on platforms without mmap support.
+func mmap(file *os.File) ([]byte, func() error, error) {
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return nil }, nil
+
+}
@@ -0,0 +1,253 @@
+package prefixserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Payload describes the thing an index entry names, for clients that show more than the name itself.
+// It is stored in the index in a compact binary encoding; see MarshalBinary.
+type Payload struct {
+	// Type is the type of the entry, such as its Java type or "method"
+	Type string `json:"type,omitempty"`
+	// Class is the class that declares the entry
+	Class string `json:"class,omitempty"`
+	// File and Line give the entry's location in the source
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	// DocURL links to the entry's documentation
+	DocURL string `json:"doc_url,omitempty"`
+	// Extra holds the payload's fields besides those above, as the JSON they were given in.
+	// The index doesn't look at them, but keeps them so that sources can hand clients more than it knows about.
+	// In JSON they sit alongside the other fields rather than under a field of their own.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// payloadFieldNames are the JSON names of the fields of a Payload that aren't kept in Extra.
+var payloadFieldNames = map[string]bool{"type": true, "class": true, "file": true, "line": true, "doc_url": true}
+
+// payloadJSON is a Payload without its JSON methods, for encoding and decoding the fields besides Extra.
+type payloadJSON Payload
+
+// MarshalJSON encodes p as a JSON object with its fields, followed by those in Extra in key order.
+// A field in Extra named like one of the others is left out.
+func (p Payload) MarshalJSON() ([]byte, error) {
+
+	data, err := json.Marshal(payloadJSON(p))
+	if err != nil || len(p.Extra) == 0 {
+		return data, err
+	}
+
+	names := make([]string, 0, len(p.Extra))
+	for name := range p.Extra {
+		if !payloadFieldNames[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer(data[:len(data)-1])
+	for _, name := range names {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		value, err := json.Marshal(p.Extra[name])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+
+}
+
+// UnmarshalJSON decodes a JSON object into p, keeping any fields it has no place for in Extra.
+func (p *Payload) UnmarshalJSON(data []byte) error {
+
+	var known payloadJSON
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	known.Extra = nil
+	for name, value := range fields {
+		if payloadFieldNames[name] {
+			continue
+		}
+		if known.Extra == nil {
+			known.Extra = map[string]json.RawMessage{}
+		}
+		known.Extra[name] = value
+	}
+	*p = Payload(known)
+
+	return nil
+
+}
+
+// IsZero reports whether p has no fields set.
+func (p *Payload) IsZero() bool {
+	return p.Type == "" && p.Class == "" && p.File == "" && p.Line == 0 && p.DocURL == "" && len(p.Extra) == 0
+}
+
+// the bits of the first byte of an encoded Payload that say which fields follow it
+const (
+	payloadType = 1 << iota
+	payloadClass
+	payloadFile
+	payloadLine
+	payloadDocURL
+	payloadExtra
+
+	payloadFields = payloadType | payloadClass | payloadFile | payloadLine | payloadDocURL | payloadExtra
+)
+
+var errBadPayload = errors.New("malformed payload")
+
+// MarshalBinary encodes p as a byte saying which of its fields are set, followed by
+// each field that is set in order: strings as a uvarint length and their bytes, Line as a uvarint,
+// and Extra as a string holding a JSON object.
+// An empty Payload encodes to nothing at all, so that entries without one take no space in the index.
+func (p *Payload) MarshalBinary() ([]byte, error) {
+
+	if p.IsZero() {
+		return nil, nil
+	}
+	if p.Line < 0 {
+		return nil, errors.New("payload line must not be negative")
+	}
+
+	buf := make([]byte, 1, 1+len(p.Type)+len(p.Class)+len(p.File)+len(p.DocURL)+5*binary.MaxVarintLen64)
+	var tmp [binary.MaxVarintLen64]byte
+
+	putString := func(bit byte, s string) {
+		if s != "" {
+			buf[0] |= bit
+			buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(s)))]...)
+			buf = append(buf, s...)
+		}
+	}
+
+	putString(payloadType, p.Type)
+	putString(payloadClass, p.Class)
+	putString(payloadFile, p.File)
+	if p.Line != 0 {
+		buf[0] |= payloadLine
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(p.Line))]...)
+	}
+	putString(payloadDocURL, p.DocURL)
+	if len(p.Extra) > 0 {
+		extra, err := json.Marshal(p.Extra)
+		if err != nil {
+			return nil, err
+		}
+		putString(payloadExtra, string(extra))
+	}
+
+	return buf, nil
+
+}
+
+// UnmarshalBinary decodes a Payload encoded by MarshalBinary.
+func (p *Payload) UnmarshalBinary(data []byte) error {
+
+	*p = Payload{}
+	if len(data) == 0 {
+		return nil
+	}
+
+	fields := data[0]
+	if fields&^payloadFields != 0 {
+		return errBadPayload
+	}
+	data = data[1:]
+
+	getUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errBadPayload
+		}
+		data = data[n:]
+		return v, nil
+	}
+
+	getString := func(bit byte, s *string) error {
+		if fields&bit == 0 {
+			return nil
+		}
+		n, err := getUvarint()
+		if err != nil {
+			return err
+		}
+		if n > uint64(len(data)) {
+			return errBadPayload
+		}
+		*s = string(data[:n])
+		data = data[n:]
+		return nil
+	}
+
+	if err := getString(payloadType, &p.Type); err != nil {
+		return err
+	}
+	if err := getString(payloadClass, &p.Class); err != nil {
+		return err
+	}
+	if err := getString(payloadFile, &p.File); err != nil {
+		return err
+	}
+	if fields&payloadLine != 0 {
+		line, err := getUvarint()
+		if err != nil {
+			return err
+		}
+		p.Line = int(line)
+	}
+	if err := getString(payloadDocURL, &p.DocURL); err != nil {
+		return err
+	}
+	var extra string
+	if err := getString(payloadExtra, &extra); err != nil {
+		return err
+	}
+	if fields&payloadExtra != 0 {
+		if err := json.Unmarshal([]byte(extra), &p.Extra); err != nil || len(p.Extra) == 0 {
+			return errBadPayload
+		}
+	}
+
+	if len(data) != 0 {
+		return errBadPayload
+	}
+
+	return nil
+
+}
+
+// Data decodes the match's payload, or returns nil if it has none.
+func (m *Match) Data() (*Payload, error) {
+
+	if len(m.Payload) == 0 {
+		return nil, nil
+	}
+
+	p := new(Payload)
+	if err := p.UnmarshalBinary(m.Payload); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+
+}
@@ -0,0 +1,134 @@
+package prefixserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPayload(t *testing.T) {
+
+	cases := []Payload{
+		{},
+		{Type: "int"},
+		{Line: 300},
+		{Type: "java.lang.String", Class: "com.example.User", File: "src/main/java/com/example/User.java", Line: 42,
+			DocURL: "https://example.com/docs/User.html#userName"},
+		{Class: "Foo", DocURL: "https://example.com/Foo"},
+		{Type: "int", Extra: map[string]json.RawMessage{"kind": json.RawMessage(`"field"`), "tags": json.RawMessage(`[1,{"a":null}]`)}},
+		{Extra: map[string]json.RawMessage{"deprecated": json.RawMessage(`true`)}},
+	}
+
+	for _, p := range cases {
+
+		data, err := p.MarshalBinary()
+		if err != nil {
+			t.Errorf("%+v: unexpected error encoding: %s", p, err)
+			continue
+		}
+
+		var decoded Payload
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Errorf("%+v: unexpected error decoding %v: %s", p, data, err)
+		} else if !reflect.DeepEqual(decoded, p) {
+			t.Errorf("expected %+v, got %+v", p, decoded)
+		}
+
+	}
+
+	if data, _ := (&Payload{}).MarshalBinary(); len(data) != 0 {
+		t.Errorf("expected an empty payload to encode to nothing, got %v", data)
+	}
+
+	full, _ := cases[3].MarshalBinary()
+	for _, bad := range [][]byte{
+		[]byte(`{"type":"int"}`),
+		full[:len(full)-1],
+		append(full, 0),
+		{payloadType, 5, 'a'},
+		{payloadExtra, 2, '[', ']'},
+		{payloadExtra, 2, '{', '}'},
+	} {
+		var p Payload
+		if err := p.UnmarshalBinary(bad); err == nil {
+			t.Errorf("expected an error decoding %v, got %+v", bad, p)
+		}
+	}
+
+	// the payload comes back through a search of either index format
+	in := New()
+	data, _ := cases[3].MarshalBinary()
+	in.AddWithPayload([]byte("username"), []byte("userName"), data, 1)
+	in.Add([]byte("user"), []byte("user"), 0)
+	in.Compact()
+
+	buf := bytes.Buffer{}
+	if err := in.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []Searcher{in, mapped} {
+
+		matches := make([]Match, 2)
+		if count := s.FindMatches([]byte("user"), 0, matches); count != 2 {
+			t.Fatalf("expected 2 results, got %d", count)
+		}
+
+		if p, err := matches[0].Data(); err != nil || p == nil || !reflect.DeepEqual(*p, cases[3]) {
+			t.Errorf("expected %+v, got %+v (err %v)", cases[3], p, err)
+		}
+		if p, err := matches[1].Data(); err != nil || p != nil {
+			t.Errorf("expected no payload, got %+v (err %v)", p, err)
+		}
+
+	}
+
+}
+
+func TestPayloadJSON(t *testing.T) {
+
+	cases := []struct {
+		json    string
+		payload Payload
+	}{
+		{`{}`, Payload{}},
+		{`{"type":"int","line":12,"doc_url":"u"}`, Payload{Type: "int", Line: 12, DocURL: "u"}},
+		// fields the payload doesn't know come after those it does, in order
+		{`{"class":"Foo","kind":"field","tags":[1,2]}`,
+			Payload{Class: "Foo", Extra: map[string]json.RawMessage{"tags": json.RawMessage(`[1,2]`), "kind": json.RawMessage(`"field"`)}}},
+		{`{"deprecated":true}`, Payload{Extra: map[string]json.RawMessage{"deprecated": json.RawMessage(`true`)}}},
+	}
+
+	for _, c := range cases {
+
+		var p Payload
+		if err := json.Unmarshal([]byte(c.json), &p); err != nil {
+			t.Errorf("%s: unexpected error decoding: %s", c.json, err)
+		} else if !reflect.DeepEqual(p, c.payload) {
+			t.Errorf("%s: expected %+v, got %+v", c.json, c.payload, p)
+		}
+
+		if data, err := json.Marshal(&c.payload); err != nil || string(data) != c.json {
+			t.Errorf("%+v: expected %s, got %s (err %v)", c.payload, c.json, data, err)
+		}
+
+	}
+
+	// a field the payload does know must still have the right type
+	var p Payload
+	if err := json.Unmarshal([]byte(`{"line":"twelve","kind":"field"}`), &p); err == nil {
+		t.Errorf("expected an error decoding a line that isn't a number, got %+v", p)
+	}
+
+	// and can't be given again through Extra
+	p = Payload{Type: "int", Extra: map[string]json.RawMessage{"type": json.RawMessage(`"long"`)}}
+	if data, err := json.Marshal(p); err != nil || string(data) != `{"type":"int"}` {
+		t.Errorf("expected Extra's type to be left out, got %s (err %v)", data, err)
+	}
+
+}
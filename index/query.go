@@ -0,0 +1,118 @@
+package prefixserver
+
+// A Query describes a search for Search, bringing together all the ways a search can be tuned.
+type Query struct {
+	Prefix []byte
+	// MaxEdits, if positive, makes the search fuzzy, as FindFuzzy does,
+	// with each edit costing a match Penalty points of score when ranking
+	MaxEdits int
+	Penalty  int
+	// Abbrev makes the search match keys that Prefix abbreviates, as FindAbbrev does, with each
+	// jump to a new word costing a match Penalty points of score. It takes precedence over MaxEdits
+	Abbrev bool
+	// CaseBoost, for an index whose keys are case folded, ranks matches whose values contain the prefix
+	// exactly as given, case and all, CaseBoost points of score ahead of those that only match once folded
+	CaseBoost int
+	// Filter, if set, is passed each match before it's counted,
+	// and only the matches for which it returns true are returned or skipped by the offset
+	Filter func(m *Match) bool
+	// Ties orders matches that rank equally, which is DefaultTieOrder if it's nil
+	Ties TieOrder
+	// Highlight, if set, fills in each match's Spans
+	Highlight bool
+	// Done, if set, abandons the search once it's closed, much as a context's Done channel does,
+	// and the search returns whatever matches it had found by then
+	Done <-chan struct{}
+
+	// form is the key form of the index being searched, into which Prefix is put
+	form KeyForm
+}
+
+// Search locates up to len(matches) entries matching q, skipping over the first offset of them, and stores them in matches.
+// It returns the number of matches stored.
+func (in *Index) Search(q *Query, offset int, matches []Match) int {
+	return searchQuery(in, q, offset, matches)
+}
+
+// Search locates up to len(matches) entries matching q, as Index.Search does.
+func (m *Mapped) Search(q *Query, offset int, matches []Match) int {
+	return searchQuery(m, q, offset, matches)
+}
+
+func searchQuery(t tree, q *Query, offset int, matches []Match) int {
+
+	prefix := q.form.Key(q.Prefix)
+
+	var m matcher = exactMatcher(prefix)
+	switch {
+	case q.Abbrev:
+		m = &abbrevMatcher{abbrev: prefix, penalty: q.Penalty, form: q.form}
+	case q.MaxEdits > 0:
+		m = &fuzzyMatcher{query: prefix, maxEdits: q.MaxEdits, penalty: q.Penalty}
+	}
+
+	m = q.wrap(m)
+	return search(t, m, q.Ties, offset, len(matches), q.found(m, matches))
+
+}
+
+// wrap adds to m whatever q asks for besides matching the prefix.
+func (q *Query) wrap(m matcher) matcher {
+
+	if q.CaseBoost > 0 && q.form.Fold != FoldNone {
+		m = caseMatcher{matcher: m, form: q.form, exact: q.form.normalize(q.Prefix), penalty: q.CaseBoost}
+	}
+
+	if q.Filter != nil {
+		m = filterMatcher{matcher: m, filter: q.Filter}
+	}
+
+	if q.Done != nil {
+		m = doneMatcher{matcher: m, done: q.Done}
+	}
+
+	return m
+
+}
+
+// found returns a function for search to store the matches m finds in matches with.
+func (q *Query) found(m matcher, matches []Match) func(i int, e *queueElement) {
+	return func(i int, e *queueElement) {
+		matches[i] = newMatch(e)
+		if q.Highlight {
+			matches[i].Spans = q.form.highlight(matches[i].Value, matches[i].Key, m.spans(e, matches[i].Key))
+		}
+	}
+}
+
+// filterMatcher is a matcher that also requires each match to pass its filter.
+type filterMatcher struct {
+	matcher
+	filter func(m *Match) bool
+}
+
+func (m filterMatcher) matched(e *queueElement) bool {
+
+	if !m.matcher.matched(e) {
+		return false
+	}
+
+	match := newMatch(e)
+	return m.filter(&match)
+
+}
+
+// doneMatcher is a matcher that stops visiting nodes once done is closed, which runs the search out of nodes.
+type doneMatcher struct {
+	matcher
+	done <-chan struct{}
+}
+
+func (m doneMatcher) step(e *queueElement) (queueElement, bool) {
+	select {
+	case <-m.done:
+		return queueElement{}, false
+	default:
+		return m.matcher.step(e)
+	}
+}
@@ -0,0 +1,174 @@
+package prefixserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+
+	index := New()
+	for i, value := range []string{"apple", "apricot", "avocado", "banana", "application", "apply"} {
+		index.Add([]byte(value), []byte(value), 10-i)
+	}
+	index.Compact()
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatalf("writing flat index: %s", err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading flat index: %s", err)
+	}
+
+	odd := func(m *Match) bool { return m.Score%2 == 1 }
+	open, done := make(chan struct{}), make(chan struct{})
+	close(done)
+
+	cases := []struct {
+		query  Query
+		offset int
+		want   []string
+	}{
+		{Query{Prefix: []byte("ap")}, 0, []string{"apple", "apricot", "application", "apply"}},
+		{Query{Prefix: []byte("ap")}, 1, []string{"apricot", "application", "apply"}},
+		{Query{Prefix: []byte("ap"), Filter: odd}, 0, []string{"apricot", "apply"}},
+		// the offset counts only matches that pass the filter
+		{Query{Prefix: []byte("ap"), Filter: odd}, 1, []string{"apply"}},
+		{Query{Prefix: []byte("bannana"), MaxEdits: 1}, 0, []string{"banana"}},
+		{Query{Prefix: []byte("apl"), MaxEdits: 1, Filter: odd}, 0, []string{"apricot", "apply"}},
+		{Query{Prefix: []byte("ap"), Done: open}, 0, []string{"apple", "apricot", "application", "apply"}},
+		// a search that's already been abandoned finds nothing
+		{Query{Prefix: []byte("ap"), Done: done}, 0, []string{}},
+		{Query{Prefix: []byte("bannana"), MaxEdits: 1, Done: done}, 0, []string{}},
+	}
+
+	for _, s := range []Searcher{index, mapped} {
+		for _, c := range cases {
+
+			matches := make([]Match, 10)
+			count := s.Search(&c.query, c.offset, matches)
+
+			got := make([]string, count)
+			for i := range got {
+				got[i] = string(matches[i].Value)
+			}
+
+			if len(got) != len(c.want) {
+				t.Errorf("%T: on search for %+v from %d, expected %q, got %q", s, c.query, c.offset, c.want, got)
+				continue
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("%T: on search for %+v from %d, expected %q, got %q", s, c.query, c.offset, c.want, got)
+					break
+				}
+			}
+
+		}
+	}
+
+}
+
+func TestSearchHighlight(t *testing.T) {
+
+	folded := KeyForm{Fold: FoldUnicode}
+
+	cases := []struct {
+		form  KeyForm
+		query Query
+		value string
+		spans []Span
+	}{
+		{KeyForm{}, Query{Prefix: []byte("lo")}, "some_long_name", []Span{{5, 2, 5, 2}}},
+		{KeyForm{}, Query{Prefix: []byte("some_l")}, "some_long_name", []Span{{0, 6, 0, 6}}},
+		// camel lower-cases the first word of its keys
+		{KeyForm{}, Query{Prefix: []byte("httpS")}, "getHTTPServer", []Span{{3, 5, 3, 5}}},
+		{KeyForm{}, Query{Prefix: []byte("Grö")}, "Größe_lang", []Span{{0, 4, 0, 3}}},
+		{KeyForm{}, Query{Prefix: []byte("lan")}, "Größe_lang", []Span{{8, 3, 6, 3}}},
+		{KeyForm{}, Query{Prefix: []byte("lnog"), MaxEdits: 2}, "some_long_name", []Span{{5, 4, 5, 4}}},
+		{KeyForm{}, Query{Prefix: []byte("gUN"), Abbrev: true}, "getUserName", []Span{{0, 1, 0, 1}, {3, 1, 3, 1}, {7, 1, 7, 1}}},
+		{KeyForm{}, Query{Prefix: []byte("getUsN"), Abbrev: true}, "getUserName", []Span{{0, 5, 0, 5}, {7, 1, 7, 1}}},
+		// extra keys aren't part of the value, so there's nothing to highlight
+		{KeyForm{}, Query{Prefix: []byte("extrasome")}, "some_long_name", []Span{}},
+		// the Kelvin sign folds to a single byte
+		{folded, Query{Prefix: []byte("GRÖ")}, "Größe_lang", []Span{{0, 4, 0, 3}}},
+		{folded, Query{Prefix: []byte("kel")}, "\u212aelvin", []Span{{0, 5, 0, 3}}},
+		{folded, Query{Prefix: []byte("VIN")}, "\u212aelvin", []Span{{5, 3, 3, 3}}},
+		// folding loses the capitals that begin words, but they're still in the value
+		{folded, Query{Prefix: []byte("gUN"), Abbrev: true}, "getUserName", []Span{{0, 1, 0, 1}, {3, 1, 3, 1}, {7, 1, 7, 1}}},
+	}
+
+	for _, form := range []KeyForm{{}, folded} {
+
+		index := New()
+		for _, name := range []string{"some_long_name", "getHTTPServer", "Größe_lang", "getUserName", "\u212aelvin"} {
+			keys := [][]byte{[]byte(name)}
+			keys = append(keys, Separators("_").Keys([]byte(name))...)
+			keys = append(keys, CamelCase.Keys([]byte(name))...)
+			keys = append(keys, []byte("extra"+name))
+			if name == "\u212aelvin" {
+				keys = append(keys, []byte("\u212aelvin"[3:]), []byte("vin"))
+			}
+			for i := range keys {
+				keys[i] = form.Key(keys[i])
+			}
+			index.AddEntry(keys, []byte(name), nil, 10)
+		}
+		index.Compact()
+
+		buf := bytes.Buffer{}
+		if err := index.WriteFlat(&buf); err != nil {
+			t.Fatalf("writing flat index: %s", err)
+		}
+		mapped, err := NewMapped(buf.Bytes())
+		if err != nil {
+			t.Fatalf("reading flat index: %s", err)
+		}
+
+		for _, s := range []Searcher{WithKeyForm(index, form), WithKeyForm(mapped, form)} {
+			for _, c := range cases {
+
+				if c.form != form {
+					continue
+				}
+
+				query := c.query
+				query.Highlight = true
+
+				matches := make([]Match, 10)
+				count := s.Search(&query, 0, matches)
+				if !c.query.Abbrev && c.query.MaxEdits == 0 {
+					// the cursor must highlight as a search from the top does
+					count = s.Cursor().Search(&query, 0, matches)
+				}
+
+				var match *Match
+				for i := range matches[:count] {
+					if string(matches[i].Value) == c.value {
+						match = &matches[i]
+					}
+				}
+				if match == nil {
+					t.Errorf("%T: on search for %s, expected to find %s, got %d results", s, c.query.Prefix, c.value, count)
+					continue
+				}
+
+				if len(match.Spans) != len(c.spans) {
+					t.Errorf("%T: on search for %s, expected %s to have spans %v, got %v", s, c.query.Prefix, c.value, c.spans, match.Spans)
+					continue
+				}
+				for i := range c.spans {
+					if match.Spans[i] != c.spans[i] {
+						t.Errorf("%T: on search for %s, expected %s to have spans %v, got %v", s, c.query.Prefix, c.value, c.spans, match.Spans)
+						break
+					}
+				}
+
+			}
+		}
+
+	}
+
+}
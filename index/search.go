@@ -0,0 +1,192 @@
+package prefixserver
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// Match is a single result of a search.
+type Match struct {
+	Value   []byte
+	Payload []byte
+	Score   int
+	// ID identifies the entry, which may have been added under several keys.
+	// IDs number entries in the order they were added to the index.
+	ID int
+	// Key is the key through which the entry was found, which for an entry added under several keys
+	// is the one that ranks best. It's in the index's key form.
+	Key []byte
+	// Edits is the number of single-byte insertions, deletions and substitutions
+	// needed to turn the query into a prefix of Key.
+	Edits int
+	// Spans locates the parts of Value that matched the query, if the query asked for them with Highlight
+	Spans []Span
+}
+
+func newMatch(e *queueElement) Match {
+	m := Match{Value: e.value, Payload: e.payload, Score: e.score, ID: e.seq, Key: e.path()}
+	if e.fuzzy != nil {
+		m.Edits = e.fuzzy.edits
+	}
+	return m
+}
+
+// path returns the key leading to e's node, including the node's own.
+func (e *queueElement) path() []byte {
+
+	key := make([]byte, e.keyLen+len(e.key))
+	end := len(key)
+	for ; e != nil; e = e.parent {
+		end -= len(e.key)
+		copy(key[end:], e.key)
+	}
+
+	return key
+
+}
+
+// tree is implemented by both index representations, so that search can walk either one.
+type tree interface {
+	root() *node
+	// children returns the children of e's node, along with the position
+	// of the first of them if the tree stores its nodes by position.
+	children(e *queueElement) ([]node, uint32)
+}
+
+// A matcher decides which paths through the index match a query.
+// It keeps track of its progress along each path in the queueElements it visits.
+type matcher interface {
+	// start returns the element with which a search begins at root.
+	start(root *node) *queueElement
+	// step reads the key of e's node, and returns a template for the elements of its children
+	// along with whether anything at or below the node can match.
+	step(e *queueElement) (queueElement, bool)
+	// admit is passed each child element just created from a template returned by step.
+	// It sets the element's cost, and reports whether the child is worth visiting at all.
+	admit(e *queueElement) bool
+	// matched reports whether the query has been matched along the path to e's node.
+	matched(e *queueElement) bool
+	// spans returns the parts of key, the key leading to e's node, that matched the query.
+	spans(e *queueElement, key []byte) []span
+}
+
+// search walks t best-first, skipping over the first offset matches it finds
+// and then passing up to limit more to found, in order, with ties broken by ties.
+// An entry reached through more than one key is only found through the first.
+// It returns the number of matches passed to found.
+func search(t tree, m matcher, ties TieOrder, offset int, limit int, found func(i int, e *queueElement)) int {
+
+	if limit <= 0 {
+		return 0
+	}
+
+	// initialize the priority queue through which we'll conduct our best-first search
+	q := new_queue(ties)
+	heap.Init(q)
+	root := t.root()
+	heap.Push(q, m.start(root))
+	matchCount := 0
+
+	// indexes written before entries had IDs give them all the same one, and the root none to hand out
+	var seen map[int]bool
+	if root.seq > 0 {
+		seen = map[int]bool{}
+	}
+
+	for q.Len() > 0 {
+
+		nextStop := heap.Pop(q).(*queueElement)
+
+		next, ok := m.step(nextStop)
+		if !ok {
+			continue
+		}
+
+		children, first := t.children(nextStop)
+		for i := range children {
+			child := new(queueElement)
+			*child = next
+			child.node = &children[i]
+			child.pos = first + uint32(i)
+			child.parent = nextStop
+			child.keyLen = nextStop.keyLen + len(nextStop.key)
+			if m.admit(child) {
+				heap.Push(q, child)
+			}
+		}
+
+		if nextStop.value != nil && m.matched(&next) {
+
+			if seen != nil {
+				if seen[next.seq] {
+					// already found this entry through a better key
+					continue
+				}
+				seen[next.seq] = true
+			}
+
+			if offset > 0 {
+				// still paging past earlier results, so just count this one off
+				offset--
+				continue
+			}
+
+			// this node has a value and matches the query, so pass it on
+			found(matchCount, &next)
+			matchCount++
+			if matchCount == limit {
+				// hit the max number of results, so stop early
+				return matchCount
+			}
+
+		}
+
+	}
+
+	return matchCount
+
+}
+
+// exactMatcher matches every path that begins with its prefix.
+// The part of the prefix not yet read is kept in queueElement.prefix.
+type exactMatcher []byte
+
+func (m exactMatcher) start(root *node) *queueElement {
+	return &queueElement{node: root, prefix: m}
+}
+
+func (m exactMatcher) step(e *queueElement) (queueElement, bool) {
+
+	next := *e
+
+	switch {
+	case len(e.prefix) == 0:
+	case bytes.HasPrefix(e.prefix, e.key):
+		next.prefix = e.prefix[len(e.key):]
+	case bytes.HasPrefix(e.key, e.prefix):
+		// the prefix ends partway through this node
+		next.prefix = e.prefix[len(e.prefix):]
+	default:
+		return next, false
+	}
+
+	return next, true
+
+}
+
+func (m exactMatcher) admit(e *queueElement) bool {
+	// once the prefix has been read, every descendant matches;
+	// until then, only a child whose key continues the prefix can
+	return len(e.prefix) == 0 || (len(e.key) > 0 && e.key[0] == e.prefix[0])
+}
+
+func (m exactMatcher) matched(e *queueElement) bool {
+	return len(e.prefix) == 0
+}
+
+func (m exactMatcher) spans(e *queueElement, key []byte) []span {
+	if len(m) == 0 {
+		return nil
+	}
+	return []span{{0, len(m)}}
+}
@@ -0,0 +1,196 @@
+package prefixserver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A TieOrder says how matches that rank equally are ordered among themselves: by each of its Ties in turn.
+// A nil TieOrder is DefaultTieOrder. An empty one leaves ties unbroken, so that equally ranked matches
+// come back in whatever order the search happens to find them, which may change from one search to the next.
+type TieOrder []Tie
+
+// A Tie is one way of breaking ties between matches.
+type Tie int
+
+const (
+	// TieValue puts values in lexicographic byte order
+	TieValue Tie = iota + 1
+	// TieKeyLength puts matches found through shorter keys first
+	TieKeyLength
+	// TieInsertion puts entries added to the index earlier first
+	TieInsertion
+)
+
+// DefaultTieOrder breaks ties by value, then key length, then insertion order.
+var DefaultTieOrder = TieOrder{TieValue, TieKeyLength, TieInsertion}
+
+var tieNames = map[Tie]string{
+	TieValue:     "value",
+	TieKeyLength: "key",
+	TieInsertion: "insertion",
+}
+
+// ParseTieOrder parses a comma-separated list of the ties a TieOrder breaks, in order:
+// value, key (for key length) and insertion, each at most once. none is the empty TieOrder,
+// and the empty string is DefaultTieOrder. It accepts anything TieOrder.String returns.
+func ParseTieOrder(s string) (TieOrder, error) {
+
+	switch s {
+	case "":
+		return DefaultTieOrder, nil
+	case "none":
+		return TieOrder{}, nil
+	}
+
+	order := TieOrder{}
+	seen := map[Tie]bool{}
+
+	for _, name := range strings.Split(s, ",") {
+
+		var tie Tie
+		for t, tieName := range tieNames {
+			if strings.TrimSpace(name) == tieName {
+				tie = t
+			}
+		}
+
+		if tie == 0 {
+			return nil, fmt.Errorf("unknown tie order %q", name)
+		}
+		if seen[tie] {
+			return nil, fmt.Errorf("tie order %q has %s more than once", s, tieNames[tie])
+		}
+		seen[tie] = true
+		order = append(order, tie)
+
+	}
+
+	return order, nil
+
+}
+
+func (o TieOrder) String() string {
+
+	if o == nil {
+		o = DefaultTieOrder
+	}
+	if len(o) == 0 {
+		return "none"
+	}
+
+	names := make([]string, len(o))
+	for i, tie := range o {
+		names[i] = tieNames[tie]
+	}
+
+	return strings.Join(names, ",")
+
+}
+
+// less reports whether a comes before b, which rank equally.
+// Nodes that aren't leaves come before leaves, so that every leaf that ranks equally with another
+// is in the queue by the time either is taken from it, and the leaves can then be ordered exactly.
+func (o TieOrder) less(a, b *queueElement) bool {
+
+	if (a.value == nil) != (b.value == nil) {
+		return a.value == nil
+	}
+	if a.value == nil {
+		return false
+	}
+
+	for _, tie := range o {
+		switch tie {
+		case TieValue:
+			if c := bytes.Compare(a.value, b.value); c != 0 {
+				return c < 0
+			}
+		case TieKeyLength:
+			if a.keyLen != b.keyLen {
+				return a.keyLen < b.keyLen
+			}
+		case TieInsertion:
+			if a.seq != b.seq {
+				return a.seq < b.seq
+			}
+		}
+	}
+
+	return false
+
+}
+
+// WithTieOrder returns a Searcher that breaks ties between the matches s finds by order,
+// except in queries that give their own. Load does this for index files with a tie order in their header.
+func WithTieOrder(s Searcher, order TieOrder) Searcher {
+	if order == nil {
+		return s
+	}
+	return &tieSearcher{Searcher: s, order: order}
+}
+
+// tieSearcher puts every search through Search, which is the only one that can be given a tie order.
+type tieSearcher struct {
+	Searcher
+	order TieOrder
+}
+
+func (s *tieSearcher) Find(key []byte, values [][]byte, scores []int) int {
+	return s.FindFrom(key, 0, values, scores)
+}
+
+// tieMatches holds the buffers of matches that tieSearcher.FindFrom collects its results in
+// before copying out their values and scores, so that a search needn't allocate one each time.
+var tieMatches = sync.Pool{New: func() interface{} { return new([]Match) }}
+
+func (s *tieSearcher) FindFrom(key []byte, offset int, values [][]byte, scores []int) int {
+
+	buf := tieMatches.Get().(*[]Match)
+	if cap(*buf) < len(values) {
+		*buf = make([]Match, len(values))
+	}
+	matches := (*buf)[:len(values)]
+
+	count := s.FindMatches(key, offset, matches)
+	for i := 0; i < count; i++ {
+		values[i] = matches[i].Value
+		scores[i] = matches[i].Score
+	}
+
+	// the matches point into the index, which mustn't be kept alive by a buffer waiting in the pool
+	clear(matches[:count])
+	tieMatches.Put(buf)
+
+	return count
+
+}
+
+func (s *tieSearcher) FindMatches(key []byte, offset int, matches []Match) int {
+	return s.Search(&Query{Prefix: key}, offset, matches)
+}
+
+func (s *tieSearcher) FindFuzzy(prefix []byte, maxEdits int, penalty int, offset int, matches []Match) int {
+	return s.Search(&Query{Prefix: prefix, MaxEdits: maxEdits, Penalty: penalty}, offset, matches)
+}
+
+func (s *tieSearcher) FindAbbrev(abbrev []byte, penalty int, offset int, matches []Match) int {
+	return s.Search(&Query{Prefix: abbrev, Abbrev: true, Penalty: penalty}, offset, matches)
+}
+
+func (s *tieSearcher) Search(q *Query, offset int, matches []Match) int {
+	if q.Ties == nil {
+		ordered := *q
+		ordered.Ties = s.order
+		q = &ordered
+	}
+	return s.Searcher.Search(q, offset, matches)
+}
+
+func (s *tieSearcher) Cursor() *Cursor {
+	c := s.Searcher.Cursor()
+	c.ties = s.order
+	return c
+}
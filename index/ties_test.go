@@ -0,0 +1,209 @@
+package prefixserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTieOrder(t *testing.T) {
+
+	cases := []struct {
+		s     string
+		order TieOrder
+		err   bool
+	}{
+		{"", DefaultTieOrder, false},
+		{"value,key,insertion", DefaultTieOrder, false},
+		{"insertion", TieOrder{TieInsertion}, false},
+		{"key, value", TieOrder{TieKeyLength, TieValue}, false},
+		{"none", TieOrder{}, false},
+		{"value,value", nil, true},
+		{"score", nil, true},
+	}
+
+	for _, c := range cases {
+		order, err := ParseTieOrder(c.s)
+		if (err != nil) != c.err {
+			t.Errorf("%q: expected error: %v, got %v", c.s, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if !reflect.DeepEqual(order, c.order) {
+			t.Errorf("%q: expected %v, got %v", c.s, c.order, order)
+		}
+		if again, err := ParseTieOrder(order.String()); err != nil || !reflect.DeepEqual(again, order) {
+			t.Errorf("%q: expected %q to parse back to %v, got %v, %v", c.s, order.String(), order, again, err)
+		}
+	}
+
+}
+
+// tiedIndex returns an index of entries that all score the same, added out of order
+// and with some values under more than one key.
+func tiedIndex() *Index {
+
+	index := New()
+	index.Add([]byte("foo_c"), []byte("foo_c"), 5)
+	index.Add([]byte("foo_a"), []byte("foo_a"), 5)
+	index.Add([]byte("foo_b_long"), []byte("foo_b"), 5)
+	index.Add([]byte("foo_b"), []byte("foo_b"), 5)
+	index.Add([]byte("foo_d"), []byte("foo_a"), 5)
+	index.Add([]byte("fooz"), []byte("fooz"), 6)
+	index.Compact()
+
+	return index
+
+}
+
+func TestTieOrder(t *testing.T) {
+
+	index := tiedIndex()
+
+	buf := bytes.Buffer{}
+	if err := index.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := NewMapped(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gobBuf := bytes.Buffer{}
+	if err := gob.NewEncoder(&gobBuf).Encode(index); err != nil {
+		t.Fatal(err)
+	}
+	decoded := New()
+	if err := gob.NewDecoder(&gobBuf).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		order    TieOrder
+		expected []string
+	}{
+		{nil, []string{"fooz", "foo_a", "foo_a", "foo_b", "foo_b", "foo_c"}},
+		{TieOrder{TieValue, TieInsertion}, []string{"fooz", "foo_a", "foo_a", "foo_b", "foo_b", "foo_c"}},
+		{TieOrder{TieInsertion}, []string{"fooz", "foo_c", "foo_a", "foo_b", "foo_b", "foo_a"}},
+		{TieOrder{TieKeyLength, TieInsertion}, []string{"fooz", "foo_c", "foo_a", "foo_b", "foo_a", "foo_b"}},
+	}
+
+	for _, searcher := range []Searcher{index, mapped, decoded} {
+		for _, c := range cases {
+
+			matches := make([]Match, 10)
+			count := searcher.Search(&Query{Prefix: []byte("foo"), Ties: c.order}, 0, matches)
+			if count != len(c.expected) {
+				t.Fatalf("%T, order %v: expected %d results, got %d", searcher, c.order, len(c.expected), count)
+			}
+
+			for i := range c.expected {
+				if string(matches[i].Value) != c.expected[i] {
+					t.Errorf("%T, order %v: expected result %d to be %s, got %s", searcher, c.order, i, c.expected[i], matches[i].Value)
+				}
+			}
+
+			// paging through one result at a time must give the same order
+			for i := range c.expected {
+				if count := searcher.Search(&Query{Prefix: []byte("foo"), Ties: c.order}, i, matches[:1]); count != 1 || string(matches[0].Value) != c.expected[i] {
+					t.Errorf("%T, order %v: expected result at offset %d to be %s, got %v", searcher, c.order, i, c.expected[i], matches[:count])
+				}
+			}
+
+		}
+	}
+
+}
+
+func TestWithTieOrder(t *testing.T) {
+
+	index := tiedIndex()
+
+	dir, err := ioutil.TempDir("", "ties")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	order := TieOrder{TieInsertion}
+
+	buf := bytes.Buffer{}
+	if err := index.WriteWithHeader(&buf, Header{TieOrder: order.String()}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _, err := Load(path)
+	if err != nil {
+		t.Fatalf("loading index: %s", err)
+	}
+
+	expected := []string{"fooz", "foo_c", "foo_a", "foo_b", "foo_b", "foo_a"}
+
+	for _, s := range []Searcher{WithTieOrder(index, order), loaded} {
+
+		matches := make([]Match, 10)
+		values := make([][]byte, 10)
+		scores := make([]int, 10)
+
+		results := map[string]func() []string{
+			"FindMatches": func() []string {
+				count := s.FindMatches([]byte("foo"), 0, matches)
+				return matchValues(matches[:count])
+			},
+			"Find": func() []string {
+				count := s.Find([]byte("foo"), values, scores)
+				found := []string{}
+				for _, value := range values[:count] {
+					found = append(found, string(value))
+				}
+				return found
+			},
+			"Cursor": func() []string {
+				count := s.Cursor().Search(&Query{Prefix: []byte("foo")}, 0, matches)
+				return matchValues(matches[:count])
+			},
+		}
+
+		for name, result := range results {
+			if found := result(); !reflect.DeepEqual(found, expected) {
+				t.Errorf("%T: %s: expected results in insertion order %v, got %v", s, name, expected, found)
+			}
+		}
+
+		// Find collects its results in a pooled buffer, rather than allocating one for each search on top of what
+		// FindMatches does
+		if ts, ok := s.(*tieSearcher); ok {
+			find := testing.AllocsPerRun(20, func() { ts.Find([]byte("foo"), values, scores) })
+			findMatches := testing.AllocsPerRun(20, func() { ts.FindMatches([]byte("foo"), 0, matches) })
+			if find >= findMatches+1 {
+				t.Errorf("expected Find to allocate no more than FindMatches, got %v allocations against %v", find, findMatches)
+			}
+		}
+
+		// a query's own order wins
+		count := s.Search(&Query{Prefix: []byte("foo"), Ties: DefaultTieOrder}, 0, matches)
+		if found := matchValues(matches[:count]); found[1] != "foo_a" || found[5] != "foo_c" {
+			t.Errorf("%T: expected the query's tie order to be used, got %v", s, found)
+		}
+
+	}
+
+}
+
+func matchValues(matches []Match) []string {
+	values := make([]string, len(matches))
+	for i := range matches {
+		values[i] = string(matches[i].Value)
+	}
+	return values
+}
@@ -0,0 +1,164 @@
+package prefixserver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A Tokenizer splits a name into words, so that the name can be indexed under
+// each suffix that starts a new word as well as under the name itself.
+type Tokenizer interface {
+	// Keys returns the extra keys under which name should be indexed, not including name itself.
+	Keys(name []byte) [][]byte
+}
+
+// separatorTokenizer starts a new word after each of its separator bytes.
+type separatorTokenizer string
+
+// Separators returns a Tokenizer that starts a new word after each occurrence of any of the bytes in seps,
+// so that Separators("_") indexes foo_bar_baz under bar_baz and baz.
+func Separators(seps string) Tokenizer {
+	return separatorTokenizer(seps)
+}
+
+func (t separatorTokenizer) Keys(name []byte) [][]byte {
+
+	keys := [][]byte{}
+
+	for i := range name {
+		if strings.IndexByte(string(t), name[i]) != -1 && i+1 < len(name) {
+			keys = append(keys, name[i+1:])
+		}
+	}
+
+	return keys
+
+}
+
+// camelCaseTokenizer starts a new word at each capital letter that follows a lower-case letter or digit,
+// and at the last capital letter of a run of them that is followed by a lower-case letter.
+type camelCaseTokenizer struct{}
+
+// CamelCase is a Tokenizer for camelCase and PascalCase names. It treats a run of capitals as an acronym,
+// so getHTTPServer is indexed under httpServer and server. The first word of each key is lower-cased,
+// which is how it would be typed at the start of a name.
+var CamelCase Tokenizer = camelCaseTokenizer{}
+
+func (t camelCaseTokenizer) Keys(name []byte) [][]byte {
+
+	starts := []int{}
+
+	var prev, cur rune
+	curPos := 0
+
+	for i, next := range string(name) {
+
+		if i > 0 && curPos > 0 && unicode.IsUpper(cur) &&
+			(unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && unicode.IsLower(next))) {
+			starts = append(starts, curPos)
+		}
+
+		prev, cur, curPos = cur, next, i
+
+	}
+
+	// the last rune has no successor, so it can only start a word after a lower-case letter or digit
+	if curPos > 0 && unicode.IsUpper(cur) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+		starts = append(starts, curPos)
+	}
+
+	keys := make([][]byte, len(starts))
+	for i, start := range starts {
+		end := len(name)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		keys[i] = append(bytes.ToLower(name[start:end]), name[end:]...)
+	}
+
+	return keys
+
+}
+
+// digitTokenizer starts a new word wherever a run of digits begins or ends.
+type digitTokenizer struct{}
+
+// Digits is a Tokenizer that starts a new word at each boundary between digits and other characters,
+// so that utf8Decode is indexed under 8Decode and Decode.
+var Digits Tokenizer = digitTokenizer{}
+
+func (t digitTokenizer) Keys(name []byte) [][]byte {
+
+	keys := [][]byte{}
+	wasDigit := false
+
+	for i, r := range string(name) {
+		isDigit := unicode.IsDigit(r)
+		if i > 0 && isDigit != wasDigit {
+			keys = append(keys, name[i:])
+		}
+		wasDigit = isDigit
+	}
+
+	return keys
+
+}
+
+// multiTokenizer indexes a name under the keys produced by any of its tokenizers.
+type multiTokenizer []Tokenizer
+
+func (t multiTokenizer) Keys(name []byte) [][]byte {
+
+	keys := [][]byte{}
+	seen := map[string]bool{string(name): true}
+
+	for _, tokenizer := range t {
+		for _, key := range tokenizer.Keys(name) {
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+
+}
+
+// Tokenizers names the built-in tokenizers for ParseTokenizers.
+var Tokenizers = map[string]Tokenizer{
+	"underscore": Separators("_"),
+	"camel":      CamelCase,
+	"dot":        Separators("."),
+	"path":       Separators("/\\"),
+	"kebab":      Separators("-"),
+	"digit":      Digits,
+}
+
+// ParseTokenizers returns a Tokenizer that combines the built-in tokenizers named in the comma-separated list names.
+// Keys produced by more than one of them are only returned once.
+func ParseTokenizers(names string) (Tokenizer, error) {
+
+	t := multiTokenizer{}
+
+	for _, name := range strings.Split(names, ",") {
+
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		tokenizer, ok := Tokenizers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tokenizer %q", name)
+		}
+
+		t = append(t, tokenizer)
+
+	}
+
+	return t, nil
+
+}
@@ -0,0 +1,56 @@
+package prefixserver
+
+import (
+	"testing"
+)
+
+func TestTokenizers(t *testing.T) {
+
+	cases := []struct {
+		tokenizers string
+		name       string
+		keys       []string
+	}{
+		{"underscore", "foo_bar_baz", []string{"bar_baz", "baz"}},
+		{"underscore", "foo__bar_", []string{"_bar_", "bar_"}},
+		{"camel", "getUserName", []string{"userName", "name"}},
+		{"camel", "HTTPServer", []string{"server"}},
+		{"camel", "getHTTPServer", []string{"httpServer", "server"}},
+		{"camel", "parseURL", []string{"url"}},
+		{"camel", "ÜberÄrger", []string{"ärger"}},
+		{"camel", "lowercase", []string{}},
+		{"dot", "java.util.List", []string{"util.List", "List"}},
+		{"path", "src/main/App.java", []string{"main/App.java", "App.java"}},
+		{"kebab", "max-line-length", []string{"line-length", "length"}},
+		{"digit", "utf8Decode", []string{"8Decode", "Decode"}},
+		{"digit", "x509", []string{"509"}},
+		{"underscore,camel", "get_userName", []string{"userName", "name"}},
+		{"camel,digit", "base64Encode", []string{"encode", "64Encode", "Encode"}},
+	}
+
+	for _, c := range cases {
+
+		tokenizer, err := ParseTokenizers(c.tokenizers)
+		if err != nil {
+			t.Fatalf("parsing %s: %s", c.tokenizers, err)
+		}
+
+		keys := tokenizer.Keys([]byte(c.name))
+		if len(keys) != len(c.keys) {
+			t.Errorf("%s: for %s expected keys %q, got %q", c.tokenizers, c.name, c.keys, keys)
+			continue
+		}
+		for i := range keys {
+			if string(keys[i]) != c.keys[i] {
+				t.Errorf("%s: for %s expected keys %q, got %q", c.tokenizers, c.name, c.keys, keys)
+				break
+			}
+		}
+
+	}
+
+	if _, err := ParseTokenizers("underscore,nonsense"); err == nil {
+		t.Errorf("expected an error for an unknown tokenizer")
+	}
+
+}
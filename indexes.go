@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// indexSet is the collection of named index files that the server serves.
+type indexSet struct {
+	// files are in the order they were given on the command line;
+	// the first is the default index, served at the legacy /{prefix} route
+	files  []*indexFile
+	byName map[string]*indexFile
+}
+
+// newIndexSet builds an indexSet from command-line arguments of the form [name=]path.
+// Without an explicit name, an index is named after its file, less any extension.
+func newIndexSet(args []string) (*indexSet, error) {
+
+	s := &indexSet{byName: map[string]*indexFile{}}
+
+	for _, arg := range args {
+
+		name, filePath := "", arg
+		if i := strings.Index(arg, "="); i != -1 {
+			name, filePath = arg[:i], arg[i+1:]
+		} else {
+			name = strings.TrimSuffix(filepath.Base(arg), filepath.Ext(arg))
+		}
+
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid index name in %q", arg)
+		}
+		if _, ok := s.byName[name]; ok {
+			return nil, fmt.Errorf("index name %s is used more than once", name)
+		}
+
+		f := newIndexFile(name, filePath)
+		s.files = append(s.files, f)
+		s.byName[name] = f
+
+	}
+
+	return s, nil
+
+}
+
+// Default returns the index served at the legacy /{prefix} route.
+func (s *indexSet) Default() *indexFile {
+	return s.files[0]
+}
+
+// Reload reloads every index in the set, carrying on past any that fail.
+// It returns the first error encountered.
+func (s *indexSet) Reload() error {
+
+	var firstErr error
+
+	for _, f := range s.files {
+		if err := f.Reload(); err != nil {
+			logger.Warnf("Reloading index %s: %s (still serving previous index)", f.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+
+}
+
+// reloadOnSignal reloads every index whenever the process receives SIGHUP.
+func (s *indexSet) reloadOnSignal() {
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		logger.Printf("Received SIGHUP")
+		s.Reload()
+	}
+
+}
+
+// handleReload is the admin endpoint for reloading indexes on demand.
+// It reloads the index named by the index query parameter, or all of them if there isn't one.
+func (s *indexSet) handleReload(w http.ResponseWriter, r *http.Request) {
+
+	logger.Printf("(%s) %s %s", r.RemoteAddr, r.Method, r.URL.RequestURI())
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if name := r.URL.Query().Get("index"); name != "" {
+
+		f, ok := s.byName[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no index named %s", name), http.StatusNotFound)
+			return
+		}
+
+		if err = f.Reload(); err != nil {
+			logger.Warnf("Reloading index %s: %s (still serving previous index)", f.name, err)
+		}
+
+	} else {
+		err = s.Reload()
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// handleList lists the indexes being served at /v1/indexes.
+func (s *indexSet) handleList(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := struct {
+		Indexes []indexStatus `json:"indexes"`
+	}{
+		Indexes: make([]indexStatus, len(s.files)),
+	}
+
+	for i, f := range s.files {
+		list.Indexes[i] = f.status()
+	}
+
+	writeJSON(w, r, http.StatusOK, &list)
+
+}
+
+// handleIndex serves queries against a single named index, at /v1/indexes/{name}/complete/{prefix}.
+func (s *indexSet) handleIndex(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/indexes/"), "/", 3)
+	if len(parts) != 3 || parts[1] != "complete" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, ok := s.byName[parts[0]]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no index named %s", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	handleQuery(w, r, f, parts[2], false)
+
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server writes two logs: the application log, of what the server itself is doing,
+// and the access log, with a line for each request. Each is either text or JSON lines.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// appLogger writes the application log, leaving out messages below its minimum level.
+type appLogger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+	min  logLevel
+}
+
+func newAppLogger(out io.Writer, json bool, min logLevel) *appLogger {
+	return &appLogger{out: out, json: json, min: min}
+}
+
+// output writes a message at level, attributing it to the caller calldepth frames up from output's caller,
+// or to net/http if calldepth is negative.
+func (l *appLogger) output(calldepth int, level logLevel, msg string) {
+
+	if level < l.min {
+		return
+	}
+
+	now := time.Now().UTC()
+	caller := "net/http"
+	if calldepth >= 0 {
+		caller = "???"
+		if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+			caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+	}
+
+	var entry []byte
+	if l.json {
+		entry, _ = json.Marshal(struct {
+			Time   time.Time `json:"time"`
+			Level  string    `json:"level"`
+			Caller string    `json:"caller"`
+			Msg    string    `json:"msg"`
+		}{now, level.String(), caller, msg})
+		entry = append(entry, '\n')
+	} else {
+		entry = []byte(fmt.Sprintf("[prefixserver] %s %s %s: %s\n",
+			now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), caller, strings.TrimSuffix(msg, "\n")))
+	}
+
+	l.mu.Lock()
+	l.out.Write(entry)
+	l.mu.Unlock()
+
+}
+
+// Printf logs at the info level.
+func (l *appLogger) Printf(format string, args ...interface{}) {
+	l.output(1, levelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *appLogger) Debugf(format string, args ...interface{}) {
+	l.output(1, levelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *appLogger) Warnf(format string, args ...interface{}) {
+	l.output(1, levelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *appLogger) Errorf(format string, args ...interface{}) {
+	l.output(1, levelError, fmt.Sprintf(format, args...))
+}
+
+// std returns a *log.Logger that logs to l at the error level, for http.Server's ErrorLog.
+func (l *appLogger) std() *log.Logger {
+	return log.New(stdLogWriter{l}, "", 0)
+}
+
+type stdLogWriter struct {
+	l *appLogger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.l.output(-1, levelError, string(p))
+	return len(p), nil
+}
+
+// accessLogger writes the access log.
+type accessLogger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+}
+
+// newAccessLogger opens the access log at dest, which is a file to append to, "-" for stdout, or "" for no log at all.
+func newAccessLogger(dest string, json bool) (*accessLogger, error) {
+
+	switch dest {
+	case "":
+		return nil, nil
+	case "-":
+		return &accessLogger{out: os.Stdout, json: json}, nil
+	}
+
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogger{out: file, json: json}, nil
+
+}
+
+// accessEntry is a line of the access log.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	URI      string    `json:"uri"`
+	Proto    string    `json:"proto"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+func (l *accessLogger) log(e *accessEntry) {
+
+	if l == nil {
+		return
+	}
+
+	var line []byte
+	if l.json {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		// the Common Log Format, plus the time taken
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %d %f\n", e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.URI+" "+e.Proto, e.Status, e.Bytes, e.Duration))
+	}
+
+	l.mu.Lock()
+	l.out.Write(line)
+	l.mu.Unlock()
+
+}
+
+// statusRecorder remembers the status code and number of bytes written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Hijack records that the connection has been taken over, as it is for a WebSocket.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.code = http.StatusSwitchingProtocols
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter, to flush it for streaming responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument wraps h so that each request it serves is counted by status code and written to the access log.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		requestsTotal.inc(strconv.Itoa(rec.code))
+		accessLog.log(&accessEntry{
+			Time:     start.UTC(),
+			Remote:   r.RemoteAddr,
+			Method:   r.Method,
+			URI:      r.RequestURI,
+			Proto:    r.Proto,
+			Status:   rec.code,
+			Bytes:    rec.bytes,
+			Duration: time.Since(start).Seconds(),
+		})
+
+	})
+}
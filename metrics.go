@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server's metrics are exposed at /metrics in the Prometheus text format,
+// which is simple enough to write by hand rather than pull in the client library for.
+
+var (
+	requestsTotal = newCounterVec("prefixserver_requests_total",
+		"HTTP requests served, by status code.", "code")
+	findSeconds = newHistogram("prefixserver_find_duration_seconds",
+		"Time spent searching the index for each query.",
+		[]float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25})
+	resultCount = newHistogram("prefixserver_results",
+		"Number of results returned for each query.",
+		[]float64{0, 1, 2, 5, 10, 20, 50, 100})
+	poolWaitSeconds = newHistogram("prefixserver_pool_wait_seconds",
+		"Time each query waited for a results buffer, which bounds how many are handled at once.",
+		[]float64{.00001, .0001, .001, .01, .1, 1})
+)
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, counts: map[string]uint64{}}
+}
+
+func (c *counterVec) inc(value string) {
+	c.mu.Lock()
+	c.counts[value]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make([]string, 0, len(c.counts))
+	for value := range c.counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.name, c.label, escapeLabel(value), c.counts[value])
+	}
+
+}
+
+// histogram counts observations into buckets by their upper bounds.
+type histogram struct {
+	name, help string
+	bounds     []float64
+
+	mu sync.Mutex
+	// counts[i] is the number of observations no greater than bounds[i], and no greater than
+	// any bound before it; the last count is for observations greater than every bound
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+
+}
+
+// observeSince observes the number of seconds since start.
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w *bufio.Writer) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	// Prometheus buckets are cumulative
+	var total uint64
+	for i, bound := range h.bounds {
+		total += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), total)
+	}
+	total += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, total)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, total)
+
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// labelEscaper escapes a label value as the Prometheus text format wants it, which is only
+// backslashes, double quotes and newlines; anything else, including other control characters
+// and non-ASCII text, goes in as it is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func (s *indexSet) handleMetrics(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	requestsTotal.write(bw)
+	findSeconds.write(bw)
+	resultCount.write(bw)
+	poolWaitSeconds.write(bw)
+
+	statuses := make([]indexStatus, len(s.files))
+	for i, f := range s.files {
+		statuses[i] = f.status()
+	}
+
+	gauges := []struct {
+		name, help string
+		value      func(st indexStatus) string
+	}{
+		{"prefixserver_index_entries", "Entries in each index.",
+			func(st indexStatus) string { return strconv.Itoa(st.Entries) }},
+		{"prefixserver_index_nodes", "Nodes in each index's tree.",
+			func(st indexStatus) string { return strconv.Itoa(st.Nodes) }},
+		{"prefixserver_index_last_load_timestamp_seconds", "When each index was last loaded, in seconds since the Unix epoch.",
+			func(st indexStatus) string { return formatFloat(float64(st.LoadedAt.UnixNano()) / 1e9) }},
+	}
+
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, st := range statuses {
+			fmt.Fprintf(bw, "%s{index=\"%s\"} %s\n", g.name, escapeLabel(st.Name), g.value(st))
+		}
+	}
+
+}
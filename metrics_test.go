@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+
+	h := newHistogram("test_seconds", "Test.", []float64{.1, 1})
+	for _, v := range []float64{.05, .1, .5, 2, 3} {
+		h.observe(v)
+	}
+
+	buf := bytes.Buffer{}
+	w := bufio.NewWriter(&buf)
+	h.write(w)
+	w.Flush()
+
+	// buckets are cumulative, and a value on a bound is in its bucket
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 5
+test_seconds_sum 5.65
+test_seconds_count 5
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+}
+
+func TestCounterVecLabels(t *testing.T) {
+
+	c := newCounterVec("test_total", "Test.", "name")
+	for _, v := range []string{`back\slash`, `"quoted"`, "new\nline", "tab\tand é"} {
+		c.inc(v)
+	}
+
+	buf := bytes.Buffer{}
+	w := bufio.NewWriter(&buf)
+	c.write(w)
+	w.Flush()
+
+	// only backslashes, double quotes and newlines are escaped; Go's quoting would escape the tab and é too
+	expected := `# HELP test_total Test.
+# TYPE test_total counter
+test_total{name="\"quoted\""} 1
+test_total{name="back\\slash"} 1
+test_total{name="new\nline"} 1
+test_total{name="tab	and é"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+}
+
+func TestMetrics(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	handler := instrument(http.HandlerFunc(handleHTTP))
+	for _, target := range []string{"/foo", "/foo", "/nothing"} {
+		serve(handler.ServeHTTP, http.MethodGet, target, "")
+	}
+
+	w := serve(indexes.handleMetrics, http.MethodGet, "/metrics", "")
+	body := w.Body.String()
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("expected the Prometheus text format, got %s", contentType)
+	}
+
+	// other tests make requests too, so only look for what these ones must have added
+	for _, line := range []string{
+		"# TYPE prefixserver_requests_total counter",
+		`prefixserver_requests_total{code="200"} `,
+		`prefixserver_requests_total{code="404"} `,
+		"# TYPE prefixserver_find_duration_seconds histogram",
+		"# TYPE prefixserver_results histogram",
+		"# TYPE prefixserver_pool_wait_seconds histogram",
+		"# TYPE prefixserver_index_entries gauge",
+		`prefixserver_index_entries{index="test"} 6` + "\n",
+		`prefixserver_index_entries{index="other"} 6` + "\n",
+		`prefixserver_index_nodes{index="test"} `,
+		`prefixserver_index_last_load_timestamp_seconds{index="test"} `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected the metrics to include %q, got\n%s", line, body)
+		}
+	}
+
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The media types query results can be returned as, in order of preference.
+const (
+	mediaJSON   = "application/json"
+	mediaNDJSON = "application/x-ndjson"
+	mediaText   = "text/plain"
+)
+
+var resultTypes = []string{mediaJSON, mediaNDJSON, mediaText}
+
+// negotiate picks the type in offers that the Accept header accept likes best, as described in RFC 7231 section 5.3.2.
+// Each offer gets the quality value of the most specific media range that matches it, and ties go to the earlier offer.
+// An empty header accepts anything. negotiate returns "" if none of offers is acceptable.
+func negotiate(accept string, offers []string) string {
+
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offers {
+
+		// specificity is 0 until a range matches, then 1 for */*, 2 for type/* and 3 for type/subtype
+		specificity, q := 0, 0.0
+
+		for _, mediaRange := range strings.Split(accept, ",") {
+
+			params := strings.Split(mediaRange, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+			s := 0
+			switch {
+			case mediaType == offer:
+				s = 3
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, mediaType[:len(mediaType)-1]):
+				s = 2
+			case mediaType == "*/*":
+				s = 1
+			}
+			if s <= specificity {
+				continue
+			}
+
+			rangeQ, ok := qValue(params[1:])
+			if !ok {
+				// ignore a range whose quality value is malformed
+				continue
+			}
+			specificity, q = s, rangeQ
+
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+
+	}
+
+	return best
+
+}
+
+// qValue finds the quality value among the parameters of a media range, which is 1 if there isn't one.
+func qValue(params []string) (float64, bool) {
+
+	for _, param := range params {
+
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, false
+		}
+		return q, true
+
+	}
+
+	return 1, true
+
+}
+
+// writeResponse encodes resp as mediaType, which must be one of resultTypes, and sends it with the given status.
+// The encoding goes through buf first, so that the response can carry its Content-Length.
+// legacy responses are in the shape of the legacy /{prefix} route: a bare array of names and scores.
+func writeResponse(w http.ResponseWriter, r *http.Request, buf *bytes.Buffer, status int, mediaType string, resp *response, legacy bool) {
+
+	buf.Reset()
+
+	switch {
+	case mediaType == mediaJSON && legacy:
+		results := make([]legacyResult, len(resp.Results))
+		for i, res := range resp.Results {
+			results[i] = legacyResult{Name: res.Name, Score: res.Score}
+		}
+		json.NewEncoder(buf).Encode(results)
+	case mediaType == mediaJSON:
+		json.NewEncoder(buf).Encode(resp)
+	case mediaType == mediaNDJSON:
+		// one result per line, which clients can handle as they arrive
+		enc := json.NewEncoder(buf)
+		for i, res := range resp.Results {
+			if legacy {
+				enc.Encode(&legacyResult{Name: res.Name, Score: res.Score})
+			} else {
+				enc.Encode(&resp.Results[i])
+			}
+		}
+	case mediaType == mediaText:
+		for _, res := range resp.Results {
+			fmt.Fprintf(buf, "%s %d\n", res.Name, res.Score)
+		}
+	}
+
+	// the formats other than JSON have nowhere to say whether there are more results, so say it here for all of them
+	w.Header().Set("X-More-Results", strconv.FormatBool(resp.More))
+	writeBuffered(w, r, buf, status, mediaType)
+
+}
+
+// writeJSON encodes v as JSON and sends it with the given status, as writeResponse does query results,
+// for the endpoints whose responses come in no other form. If the request doesn't accept JSON it gets a 406 instead.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+
+	if negotiate(r.Header.Get("Accept"), []string{mediaJSON}) == "" {
+		http.Error(w, "responses are available as "+mediaJSON, http.StatusNotAcceptable)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		logger.Warnf("Encoding a response: %s", err)
+		http.Error(w, "can't encode the response", http.StatusInternalServerError)
+		return
+	}
+
+	writeBuffered(w, r, &buf, status, mediaJSON)
+
+}
+
+// writeBuffered sends the response in buf, which is of type mediaType, with the given status and its Content-Length.
+func writeBuffered(w http.ResponseWriter, r *http.Request, buf *bytes.Buffer, status int, mediaType string) {
+
+	if mediaType == mediaText {
+		w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", mediaType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Warnf("While sending a response: %s", err)
+	}
+
+}
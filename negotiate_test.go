@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+
+	cases := []struct {
+		accept   string
+		expected string
+	}{
+		{"", mediaJSON},
+		{"  ", mediaJSON},
+		{"*/*", mediaJSON},
+		{"application/json", mediaJSON},
+		{"text/plain", mediaText},
+		{"application/x-ndjson, application/json", mediaJSON},
+		{"application/json;q=0.5, application/x-ndjson", mediaNDJSON},
+		{"text/*;q=0.9, */*;q=0.1", mediaText},
+		// the most specific range that matches an offer gives its quality, however it compares with the others
+		{"*/*, application/json;q=0", mediaNDJSON},
+		{"APPLICATION/JSON", mediaJSON},
+		{"text/plain;charset=utf-8;q=0.8, application/json;q=0.7", mediaText},
+		// a malformed quality value leaves the range out
+		{"text/plain;q=2, application/json;q=0.1", mediaJSON},
+		{"text/plain;q=x", ""},
+		{"image/png", ""},
+		{"application/json;q=0", ""},
+	}
+
+	for _, c := range cases {
+		if got := negotiate(c.accept, resultTypes); got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.accept, c.expected, got)
+		}
+	}
+
+}
+
+func TestServeQueryMediaTypes(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"text/plain", http.StatusOK, "text/plain; charset=utf-8", "foo_bar 10\nfoo_baz 5\n"},
+		{"application/x-ndjson", http.StatusOK, mediaNDJSON,
+			`{"name":"foo_bar","score":10,"key":"foo_bar","data":{"type":"function","class":"Foo"}}` + "\n" +
+				`{"name":"foo_baz","score":5,"key":"foo_baz","data":{"type":"variable","class":"Foo"}}` + "\n"},
+		{"image/png", http.StatusNotAcceptable, "", ""},
+	}
+
+	for _, c := range cases {
+
+		w := serveWith(indexes.handleComplete, http.MethodGet, "/v1/complete?q=foo&limit=2", "", c.accept)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.accept, c.status, w.Code, w.Body)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		if got := w.Header().Get("Content-Type"); got != c.contentType {
+			t.Errorf("%s: expected Content-Type %s, got %s", c.accept, c.contentType, got)
+		}
+		if got := w.Header().Get("X-More-Results"); got != "true" {
+			t.Errorf("%s: expected X-More-Results true, got %s", c.accept, got)
+		}
+		if w.Body.String() != c.body {
+			t.Errorf("%s: expected %q, got %q", c.accept, c.body, w.Body)
+		}
+
+	}
+
+	w := serve(handleHTTP, http.MethodHead, "/foo", "")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "0" {
+		t.Errorf("expected HEAD to get the headers of a response without its body, got %d, %q, %v", w.Code, w.Body, w.Header())
+	}
+
+}
+
+func TestJSONEndpointsNegotiate(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	endpoints := []struct {
+		handler      http.HandlerFunc
+		method, path string
+		body         string
+	}{
+		{indexes.handleBatch, http.MethodPost, "/v1/complete/batch", `{"queries":[{"prefix":"foo"}]}`},
+		{indexes.handleList, http.MethodGet, "/v1/indexes", ""},
+		{indexes.handleInfo, http.MethodGet, "/v1/info", ""},
+	}
+
+	for _, e := range endpoints {
+
+		for _, accept := range []string{"", "application/json", "text/*;q=0.5, application/*"} {
+			w := serveWith(e.handler, e.method, e.path, e.body, accept)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s with Accept %q: expected status 200, got %d: %s", e.path, accept, w.Code, w.Body)
+				continue
+			}
+			if got := w.Header().Get("Content-Type"); got != mediaJSON {
+				t.Errorf("%s with Accept %q: expected Content-Type %s, got %s", e.path, accept, mediaJSON, got)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("%s with Accept %q: expected Content-Length %d, got %s", e.path, accept, w.Body.Len(), got)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("%s with Accept %q: expected Vary Accept, got %s", e.path, accept, got)
+			}
+		}
+
+		if w := serveWith(e.handler, e.method, e.path, e.body, "text/plain"); w.Code != http.StatusNotAcceptable {
+			t.Errorf("%s with Accept text/plain: expected status 406, got %d: %s", e.path, w.Code, w.Body)
+		}
+
+	}
+
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	index "github.com/goldibex/prefixserver/index"
+)
+
+// Just enough of the protocol buffers wire format to encode and decode the messages in prefixserver.proto,
+// which is a lot less than the protobuf and gRPC libraries would bring with them.
+
+// the wire types of protocol buffer fields
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errBadMessage = errors.New("malformed protocol buffer message")
+
+// pbBuffer is a protocol buffer message being encoded. Scalar fields with zero values are left out, as in proto3.
+type pbBuffer []byte
+
+func (b *pbBuffer) tag(field int, wire int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wire))
+}
+
+func (b *pbBuffer) varint(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, wireVarint)
+		*b = binary.AppendUvarint(*b, v)
+	}
+}
+
+// int encodes v as an int32 or int64 field, which are both sign-extended to 64 bits on the wire.
+func (b *pbBuffer) int(field int, v int) {
+	b.varint(field, uint64(int64(v)))
+}
+
+func (b *pbBuffer) bool(field int, v bool) {
+	if v {
+		b.varint(field, 1)
+	}
+}
+
+func (b *pbBuffer) bytes(field int, v []byte) {
+	if len(v) != 0 {
+		b.tag(field, wireBytes)
+		*b = binary.AppendUvarint(*b, uint64(len(v)))
+		*b = append(*b, v...)
+	}
+}
+
+func (b *pbBuffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+// message encodes v as a message field. Unlike the scalar fields it's written even if it's empty, since an element
+// of a repeated field has to be there to be counted, and a singular one to tell its absence from its zero value.
+func (b *pbBuffer) message(field int, v []byte) {
+	b.tag(field, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// pbReader reads the fields of an encoded protocol buffer message in turn.
+type pbReader struct {
+	data []byte
+	err  error
+}
+
+// next reads the next field, returning its number and wire type, along with its value:
+// in v for varints and fixed-width fields, and in b for length-delimited ones.
+// It returns false at the end of the message, or if the message is malformed, in which case r.err is set.
+func (r *pbReader) next() (field int, wire int, v uint64, b []byte, ok bool) {
+
+	if len(r.data) == 0 || r.err != nil {
+		return 0, 0, 0, nil, false
+	}
+
+	tag, n := binary.Uvarint(r.data)
+	if n <= 0 || tag>>3 == 0 {
+		r.err = errBadMessage
+		return 0, 0, 0, nil, false
+	}
+	r.data = r.data[n:]
+	field, wire = int(tag>>3), int(tag&7)
+
+	switch wire {
+	case wireVarint:
+		if v, n = binary.Uvarint(r.data); n <= 0 {
+			r.err = errBadMessage
+			return 0, 0, 0, nil, false
+		}
+		r.data = r.data[n:]
+	case wireFixed64:
+		if len(r.data) < 8 {
+			r.err = errBadMessage
+			return 0, 0, 0, nil, false
+		}
+		v, r.data = binary.LittleEndian.Uint64(r.data), r.data[8:]
+	case wireFixed32:
+		if len(r.data) < 4 {
+			r.err = errBadMessage
+			return 0, 0, 0, nil, false
+		}
+		v, r.data = uint64(binary.LittleEndian.Uint32(r.data)), r.data[4:]
+	case wireBytes:
+		length, n := binary.Uvarint(r.data)
+		if n <= 0 || length > uint64(len(r.data)-n) {
+			r.err = errBadMessage
+			return 0, 0, 0, nil, false
+		}
+		b, r.data = r.data[n:n+int(length)], r.data[n+int(length):]
+	default:
+		r.err = errBadMessage
+		return 0, 0, 0, nil, false
+	}
+
+	return field, wire, v, b, true
+
+}
+
+// decodeCompleteRequest decodes a CompleteRequest message into q, and returns its id.
+// Fields of the wrong wire type are treated as malformed, and unknown fields are skipped.
+func decodeCompleteRequest(data []byte, q *query) (uint64, error) {
+
+	var id uint64
+	r := pbReader{data: data}
+
+	for {
+
+		field, wire, v, b, ok := r.next()
+		if !ok {
+			break
+		}
+
+		switch {
+		case field == 1 && wire == wireBytes:
+			q.Prefix = string(b)
+		case field == 2 && wire == wireBytes:
+			q.Index = string(b)
+		case field == 3 && wire == wireVarint:
+			q.Limit = int(int32(v))
+		case field == 4 && wire == wireVarint:
+			q.Offset = int(int32(v))
+		case field == 5 && wire == wireBytes:
+			if err := decodeFilters(b, &q.Filters); err != nil {
+				return 0, err
+			}
+		case field == 6 && wire == wireVarint:
+			q.Options.Fuzzy = int(int32(v))
+		case field == 7 && wire == wireVarint:
+			id = v
+		case field == 8 && wire == wireBytes:
+			q.Options.Mode = string(b)
+		case field == 9 && wire == wireVarint:
+			q.Options.Highlight = v != 0
+		case field >= 1 && field <= 9:
+			return 0, errBadMessage
+		}
+
+	}
+
+	return id, r.err
+
+}
+
+func decodeFilters(data []byte, filters *queryFilters) error {
+
+	r := pbReader{data: data}
+
+	for {
+
+		field, wire, v, b, ok := r.next()
+		if !ok {
+			break
+		}
+
+		switch {
+		case field == 1 && wire == wireBytes:
+			filters.Type = string(b)
+		case field == 2 && wire == wireBytes:
+			filters.Class = string(b)
+		case field == 3 && wire == wireVarint:
+			minScore := int(int64(v))
+			filters.MinScore = &minScore
+		case field >= 1 && field <= 3:
+			return errBadMessage
+		}
+
+	}
+
+	return r.err
+
+}
+
+// encodeCompleteResponse encodes resp as a CompleteResponse message with the given id.
+func encodeCompleteResponse(resp *response, id uint64) []byte {
+
+	var b, res, data, span pbBuffer
+
+	for i := range resp.Results {
+
+		res = res[:0]
+		res.string(1, resp.Results[i].Name)
+		res.int(2, resp.Results[i].Score)
+		if resp.Results[i].Edits != nil {
+			res.int(3, *resp.Results[i].Edits)
+		}
+		if resp.Results[i].Data != nil {
+			data = encodePayload(data[:0], resp.Results[i].Data)
+			res.message(4, data)
+		}
+		res.string(5, resp.Results[i].Key)
+		for _, match := range resp.Results[i].Matches {
+			span = span[:0]
+			span.int(1, match.Start)
+			span.int(2, match.End)
+			res.message(6, span)
+		}
+
+		b.message(1, res)
+
+	}
+
+	b.bool(2, resp.More)
+	b.varint(3, id)
+
+	return b
+
+}
+
+func encodePayload(b pbBuffer, p *index.Payload) pbBuffer {
+	b.string(1, p.Type)
+	b.string(2, p.Class)
+	b.string(3, p.File)
+	b.int(4, p.Line)
+	b.string(5, p.DocURL)
+	if len(p.Extra) > 0 {
+		extra, _ := json.Marshal(p.Extra)
+		b.string(6, string(extra))
+	}
+	return b
+}
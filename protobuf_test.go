@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	index "github.com/goldibex/prefixserver/index"
+	"reflect"
+	"testing"
+)
+
+// minusOne is -1 as an int32 or int64 field encodes it, sign-extended to ten bytes of varint.
+const minusOne = "\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"
+
+func TestDecodeCompleteRequest(t *testing.T) {
+
+	minScore := -1
+
+	cases := []struct {
+		msg string
+		q   query
+		id  uint64
+		err bool
+	}{
+		{"", query{}, 0, false},
+		{"\x0a\x03foo", query{Prefix: "foo"}, 0, false},
+		{
+			"\x0a\x03foo" + // prefix
+				"\x12\x04test" + // index
+				"\x18\x05" + // limit
+				"\x20\x02" + // offset
+				"\x2a\x1a" + "\x0a\x08function" + "\x12\x03Foo" + "\x18" + minusOne + // filters
+				"\x30\x01" + // fuzzy
+				"\x38\xac\x02" + // id, 300
+				"\x42\x06abbrev" + // mode
+				"\x48\x01", // highlight
+			query{
+				Prefix:  "foo",
+				Index:   "test",
+				Limit:   5,
+				Offset:  2,
+				Filters: queryFilters{Type: "function", Class: "Foo", MinScore: &minScore},
+				Options: queryOptions{Fuzzy: 1, Mode: modeAbbrev, Highlight: true},
+			},
+			300, false,
+		},
+		{"\x18" + minusOne, query{Limit: -1}, 0, false},
+		// a later field replaces an earlier one
+		{"\x0a\x03foo\x0a\x03bar", query{Prefix: "bar"}, 0, false},
+		// unknown fields of every wire type are skipped
+		{"\x68\x01" + "\x51" + "12345678" + "\x5a\x02ab" + "\x65" + "1234" + "\x0a\x01x", query{Prefix: "x"}, 0, false},
+		{"\x0a\x05foo", query{}, 0, true},
+		{"\x0a", query{}, 0, true},
+		{"\x18\x80", query{}, 0, true},
+		{"\x51" + "1234", query{}, 0, true},
+		// known fields of the wrong wire type
+		{"\x08\x01", query{}, 0, true},
+		{"\x2a\x02\x08\x01", query{}, 0, true},
+		// field 0, and wire types 3 and 4 for groups, which proto3 doesn't have
+		{"\x00\x01", query{}, 0, true},
+		{"\x0b", query{}, 0, true},
+		{"\x0c", query{}, 0, true},
+	}
+
+	for _, c := range cases {
+
+		q := query{}
+		id, err := decodeCompleteRequest([]byte(c.msg), &q)
+		if (err != nil) != c.err {
+			t.Errorf("%q: expected error: %v, got %v", c.msg, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+
+		if id != c.id {
+			t.Errorf("%q: expected id %d, got %d", c.msg, c.id, id)
+		}
+		if !reflect.DeepEqual(q, c.q) {
+			t.Errorf("%q: expected %+v, got %+v", c.msg, c.q, q)
+		}
+
+	}
+
+}
+
+func TestEncodeCompleteResponse(t *testing.T) {
+
+	edits := 1
+
+	cases := []struct {
+		resp response
+		id   uint64
+		msg  string
+	}{
+		// everything is left at its zero value
+		{response{}, 0, ""},
+		{response{More: true}, 300, "\x10\x01\x18\xac\x02"},
+		{
+			response{
+				Results: []result{
+					{
+						Name:    "foo",
+						Score:   10,
+						Edits:   &edits,
+						Data:    &index.Payload{Type: "t", Line: 12},
+						Key:     "foo",
+						Matches: []highlight{{Start: 0, End: 3}},
+					},
+					{Name: "b", Score: -1, Key: "b", Matches: []highlight{}},
+				},
+				More: true,
+			},
+			7,
+			"\x0a\x19" + // the first result
+				"\x0a\x03foo" + // name
+				"\x10\x0a" + // score
+				"\x18\x01" + // edits
+				"\x22\x05" + "\x0a\x01t" + "\x20\x0c" + // data
+				"\x2a\x03foo" + // key
+				"\x32\x02" + "\x10\x03" + // a match, which starts at 0
+				"\x0a\x11" + "\x0a\x01b" + "\x10" + minusOne + "\x2a\x01b" + // the second
+				"\x10\x01" + // more
+				"\x18\x07", // id
+		},
+		// no edits is left out like any other zero value, so it looks no different from an exact match
+		{response{Results: []result{{Name: "a", Edits: new(int)}}}, 0, "\x0a\x03\x0a\x01a"},
+		// but messages are written even when they're empty, so that none go missing from a repeated field
+		{
+			response{Results: []result{{}, {Data: &index.Payload{}, Matches: []highlight{{Start: 0, End: 0}}}, {}}},
+			0,
+			"\x0a\x00" + "\x0a\x04" + "\x22\x00" + "\x32\x00" + "\x0a\x00",
+		},
+		// payload fields the index doesn't know go as a JSON object
+		{
+			response{Results: []result{{Name: "a", Data: &index.Payload{Extra: map[string]json.RawMessage{"x": json.RawMessage(`1`)}}}}},
+			0,
+			"\x0a\x0e" + "\x0a\x01a" + "\x22\x09" + "\x32\x07{\"x\":1}",
+		},
+	}
+
+	for _, c := range cases {
+		if msg := encodeCompleteResponse(&c.resp, c.id); !bytes.Equal(msg, []byte(c.msg)) {
+			t.Errorf("%+v: expected %q, got %q", c.resp, c.msg, msg)
+		}
+	}
+
+}
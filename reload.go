@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// indexFile holds the index currently being served from a file on disk,
+// and swaps in a fresh copy of it whenever it is reloaded.
+type indexFile struct {
+	name string
+	path string
+
+	// current holds the *loadedIndex in service. Requests load it once and
+	// use that copy throughout, so a reload never changes an index mid-query.
+	current atomic.Value
+
+	// reloading is 1 while the index file is being loaded, which fails readiness checks.
+	reloading int32
+
+	// mu serializes reloads and guards the fields below.
+	mu       sync.Mutex
+	modTime  time.Time
+	loadedAt time.Time
+	// builtAt, checksum and header describe the file that loadedAt was loaded from
+	builtAt  time.Time
+	checksum string
+	header   *index.Header
+}
+
+// loadedIndex wraps each index loaded, since atomic.Value insists that
+// everything stored in it has the same concrete type, and an index file
+// may be in either format.
+type loadedIndex struct {
+	index.Searcher
+	// entries counts the index's entries the first time it's called, since that means reading all of a flat index
+	entries   func() int
+	nodes     int
+	footprint int
+}
+
+func newIndexFile(name, path string) *indexFile {
+	return &indexFile{name: name, path: path}
+}
+
+// Index returns the index currently in service.
+func (f *indexFile) Index() index.Searcher {
+	return f.current.Load().(*loadedIndex).Searcher
+}
+
+// Reload decodes the index file and, if that succeeds, puts the result into service.
+// If it fails, the previous index stays in service.
+func (f *indexFile) Reload() error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.reload()
+
+}
+
+func (f *indexFile) reload() error {
+
+	atomic.StoreInt32(&f.reloading, 1)
+	defer atomic.StoreInt32(&f.reloading, 0)
+
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Loading index %s from %s", f.name, f.path)
+
+	if verifyIndexes {
+		if err := index.Verify(f.path); err != nil {
+			return err
+		}
+	}
+
+	// a memory-mapped index that this replaces is unmapped once the last request using it lets go
+	in, header, err := index.Load(f.path)
+	if err != nil {
+		return err
+	}
+
+	builtAt := stat.ModTime()
+	var checksum string
+	if header != nil {
+		// Load has already checked the body against the checksum in the header, so there's no need to read it again
+		checksum = fmt.Sprintf("crc32c:%08x", header.BodyCRC32C)
+		builtAt = header.BuiltAt
+		logger.Printf("Index %s was built by %s at %s from a %s source with SHA-256 %s", f.name,
+			header.Builder, header.BuiltAt.Format(time.RFC3339), header.SourceFormat, header.SourceSHA256)
+	} else {
+		logger.Printf("Index %s has no header, so its provenance is unknown", f.name)
+		if checksum, err = fileChecksum(f.path); err != nil {
+			return err
+		}
+	}
+
+	f.current.Store(&loadedIndex{Searcher: in, entries: sync.OnceValue(in.Entries), nodes: in.Nodes(), footprint: in.Footprint()})
+	f.modTime = stat.ModTime()
+	f.loadedAt = time.Now()
+	f.builtAt = builtAt
+	f.checksum = checksum
+	f.header = header
+
+	logger.Printf("Index %s loaded.", f.name)
+
+	return nil
+
+}
+
+// loaded reports whether an index has been put into service, and isn't being reloaded.
+func (f *indexFile) loaded() bool {
+	return f.current.Load() != nil && atomic.LoadInt32(&f.reloading) == 0
+}
+
+// fileChecksum returns the hex-encoded SHA-256 hash of the file at path, prefixed with sha256:.
+func fileChecksum(path string) (string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+
+}
+
+// reloadIfModified reloads the index file if its modification time has changed since it was last loaded.
+func (f *indexFile) reloadIfModified() error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	if stat.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	// remember this version even if it fails to load, so that a broken file
+	// is reported once rather than on every poll
+	f.modTime = stat.ModTime()
+
+	return f.reload()
+
+}
+
+// watch polls the index file every interval and reloads it when it changes.
+func (f *indexFile) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := f.reloadIfModified(); err != nil {
+			logger.Warnf("Reloading index %s: %s (still serving previous index)", f.name, err)
+		}
+	}
+}
+
+// indexStatus describes an index file in the listing of indexes.
+type indexStatus struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Format  string `json:"format"`
+	Entries int    `json:"entries"`
+	Nodes   int    `json:"nodes"`
+	// MemoryBytes is roughly how much memory the index takes up. For a flat index
+	// this is mapped from the file, and shared with any other process mapping it.
+	MemoryBytes int `json:"memory_bytes"`
+	// Checksum is the CRC-32C of the body recorded in the header, as crc32c:<hex>,
+	// or for files without a header the SHA-256 of the whole file, as sha256:<hex>
+	Checksum string `json:"checksum"`
+	// BuiltAt comes from the index file's header, or is its modification time if it has none
+	BuiltAt  time.Time     `json:"built_at"`
+	LoadedAt time.Time     `json:"loaded_at"`
+	Header   *index.Header `json:"header,omitempty"`
+}
+
+func (f *indexFile) status() indexStatus {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := f.current.Load().(*loadedIndex)
+
+	format := "gob"
+	if f.header != nil {
+		format = f.header.Format
+	} else if _, ok := current.Searcher.(*index.Mapped); ok {
+		format = "flat"
+	}
+
+	return indexStatus{
+		Name:        f.name,
+		Path:        f.path,
+		Format:      format,
+		Entries:     current.entries(),
+		Nodes:       current.nodes,
+		MemoryBytes: current.footprint,
+		Checksum:    f.checksum,
+		BuiltAt:     f.builtAt.UTC(),
+		LoadedAt:    f.loadedAt.UTC(),
+		Header:      f.header,
+	}
+
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	index "github.com/goldibex/prefixserver/index"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeTestIndex replaces the index file f is loaded from with one holding names, each scored 1,
+// and moves its modification time on by a second so that the change is noticed.
+func writeTestIndex(t *testing.T, f *indexFile, names ...string) {
+
+	in := index.New()
+	for _, name := range names {
+		in.Add([]byte(name), []byte(name), 1)
+	}
+	in.Compact()
+
+	buf := bytes.Buffer{}
+	if err := in.WriteWithHeader(&buf, index.Header{}, false); err != nil {
+		t.Fatal(err)
+	}
+	touchTestIndex(t, f, buf.Bytes())
+
+}
+
+// touchTestIndex replaces the index file f is loaded from with data, and moves its modification time on by a second.
+func touchTestIndex(t *testing.T, f *indexFile, data []byte) {
+
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := stat.ModTime().Add(time.Second)
+	if err := os.Chtimes(f.path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+// firstName returns the best match for prefix in the index f is serving, or "" if there is none.
+func firstName(f *indexFile, prefix string) string {
+	values := make([][]byte, 1)
+	if f.Index().Find([]byte(prefix), values, make([]int, 1)) == 0 {
+		return ""
+	}
+	return string(values[0])
+}
+
+func TestReloadIfModified(t *testing.T) {
+
+	defer startTestServer(t)()
+	f := indexes.byName["test"]
+
+	// nothing is reloaded until the file changes
+	loadedAt := f.status().LoadedAt
+	if err := f.reloadIfModified(); err != nil || f.status().LoadedAt != loadedAt {
+		t.Errorf("expected an unchanged file not to be reloaded, got error %v", err)
+	}
+
+	writeTestIndex(t, f, "fresh")
+	if err := f.reloadIfModified(); err != nil {
+		t.Fatal(err)
+	}
+	if name := firstName(f, "f"); name != "fresh" {
+		t.Errorf("expected the new index to be in service, got %q first", name)
+	}
+	if st := f.status(); st.Entries != 1 || !st.LoadedAt.After(loadedAt) {
+		t.Errorf("expected the status to describe the new index, got %+v", st)
+	}
+
+	// a broken file is reported once, and the previous index stays in service
+	touchTestIndex(t, f, []byte("not an index"))
+	if err := f.reloadIfModified(); err == nil {
+		t.Errorf("expected an error loading a broken index")
+	}
+	if err := f.reloadIfModified(); err != nil {
+		t.Errorf("expected a broken index to be reported only once, got %s", err)
+	}
+	if name := firstName(f, "f"); name != "fresh" {
+		t.Errorf("expected the previous index to stay in service, got %q first", name)
+	}
+	if !f.loaded() {
+		t.Errorf("expected the index to count as loaded after a failed reload")
+	}
+
+	// the other index is left alone throughout
+	if name := firstName(indexes.byName["other"], "f"); name != "foo_bar" {
+		t.Errorf("expected the other index to be untouched, got %q first", name)
+	}
+
+}
+
+func TestHandleReload(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodGet, "/reload", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/reload?index=nope", http.StatusNotFound},
+		{http.MethodPost, "/reload?index=test", http.StatusNoContent},
+		{http.MethodPost, "/reload", http.StatusNoContent},
+	}
+
+	for _, c := range cases {
+		if w := serve(indexes.handleReload, c.method, c.target, ""); w.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", c.method, c.target, c.status, w.Code, w.Body)
+		}
+	}
+
+	// a reload on request doesn't wait for the file's modification time to change
+	test, other := indexes.byName["test"], indexes.byName["other"]
+	writeTestIndex(t, test, "fresh")
+	writeTestIndex(t, other, "frozen")
+	if w := serve(indexes.handleReload, http.MethodPost, "/reload?index=test", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body)
+	}
+	if name := firstName(test, "f"); name != "fresh" {
+		t.Errorf("expected the reloaded index to be in service, got %q first", name)
+	}
+	if name := firstName(other, "f"); name != "foo_bar" {
+		t.Errorf("expected only the index asked for to be reloaded, got %q first in the other", name)
+	}
+
+	// a failure is reported, but the rest are still reloaded
+	touchTestIndex(t, test, []byte("not an index"))
+	if w := serve(indexes.handleReload, http.MethodPost, "/reload", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500 for a broken index, got %d: %s", w.Code, w.Body)
+	}
+	if name := firstName(test, "f"); name != "fresh" {
+		t.Errorf("expected the previous index to stay in service, got %q first", name)
+	}
+	if name := firstName(other, "f"); name != "frozen" {
+		t.Errorf("expected the other index to be reloaded, got %q first", name)
+	}
+
+}
+
+func TestReloadVerify(t *testing.T) {
+
+	defer startTestServer(t)()
+	defer func() { verifyIndexes = false }()
+	f := indexes.byName["test"]
+
+	in := index.New()
+	in.Add([]byte("fresh"), []byte("fresh"), 1)
+	buf := bytes.Buffer{}
+	if err := in.WriteWithHeader(&buf, index.Header{}, true); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := buf.Bytes()
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	// a flat index is only checked in full with -verify
+	verifyIndexes = true
+	touchTestIndex(t, f, corrupt)
+	if err := f.Reload(); err == nil {
+		t.Errorf("expected a corrupt index to be refused with -verify")
+	}
+	if name := firstName(f, "f"); name != "foo_bar" {
+		t.Errorf("expected the previous index to stay in service, got %q first", name)
+	}
+
+	verifyIndexes = false
+	if err := f.Reload(); err != nil {
+		t.Errorf("expected a flat index to be loaded from its header alone without -verify, got %s", err)
+	}
+
+}
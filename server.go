@@ -1,41 +1,94 @@
 package main
 
 import (
-	"encoding/gob"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	index "github.com/goldibex/prefixserver/index"
-	"log"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type result struct {
 	Name  string `json:"name"`
 	Score int    `json:"score"`
+	// Key is the key through which the result was found
+	Key string `json:"key"`
+	// Matches locates the parts of the name that matched the query, if highlighting was asked for
+	Matches []highlight `json:"matches,omitempty"`
+	// Edits is only reported for fuzzy queries
+	Edits *int `json:"edits,omitempty"`
+	// Data describes the entry, if the index has a payload for it
+	Data *index.Payload `json:"data,omitempty"`
 }
 
+// highlight is a part of a result's name that matched the query,
+// from the rune at start up to but not including the one at end.
+type highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// legacyResult is a result as the unversioned /{prefix} route returns it, which is all it has ever returned.
+type legacyResult struct {
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
+
+type response struct {
+	Results []result `json:"results"`
+	More    bool     `json:"more"`
+}
+
+// resultsBuffer has room for size results, plus one more so that
+// a query can tell whether there are further results past its limit.
 type resultsBuffer struct {
-	values  [][]byte
-	scores  []int
+	matches []index.Match
 	results []result
+	// buf holds the encoded response
+	buf bytes.Buffer
 }
 
-func newResultsBuffer() *resultsBuffer {
+func newResultsBuffer(size int) *resultsBuffer {
 	return &resultsBuffer{
-		values:  make([][]byte, 10),
-		scores:  make([]int, 10),
-		results: make([]result, 10),
+		matches: make([]index.Match, size+1),
+		results: make([]result, size+1),
 	}
 }
 
-var logger *log.Logger
-var in *index.Index
+// Exit statuses, so that scripts and supervisors can tell failures apart.
+const (
+	// exitFailure is for failures while running, such as being unable to listen
+	exitFailure = 1
+	// exitUsage is for bad flags or arguments
+	exitUsage = 2
+	// exitIO is for index files that can't be read
+	exitIO = 3
+	// exitFormat is for index files that aren't valid indexes
+	exitFormat = 4
+)
+
+var logger *appLogger
+var accessLog *accessLogger
+var indexes *indexSet
 var pool chan *resultsBuffer
+var defaultLimit, maxLimit int
+var maxOffset int
+var maxEdits, editPenalty int
+var jumpPenalty int
+var caseBoost int
+var maxBatch int
+var sessionIdleTimeout time.Duration
+var sessionOrigins []string
+var verifyIndexes bool
 
 func main() {
 
@@ -45,37 +98,95 @@ func main() {
 	addr := flag.String("addr", ":8080", "TCP address to listen on for Web server")
 	tlsCertFile := flag.String("tls-cert", "", "Path to TLS certificate for server SSL")
 	tlsKeyFile := flag.String("tls-key", "", "Path to TLS key for server SSL")
+	admin := flag.Bool("admin", false, "Enable the admin server for reloading indexes on demand")
+	adminAddr := flag.String("admin-addr", "localhost:6061", "TCP address to listen on for admin server")
+	grpcAddr := flag.String("grpc-addr", "", "TCP address to listen on for gRPC server (empty disables)")
+	flag.BoolVar(&verifyIndexes, "verify", false, "Read the whole of each index file and check it against its checksum and its own structure before putting it into service, rather than only its header")
+	watch := flag.Duration("watch", 0, "Interval at which to check the index files for changes and reload them (0 disables)")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "Time to fail readiness checks on SIGTERM before draining connections, which should be longer than the load balancer's health check interval")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "Maximum time to wait for requests in flight to finish on shutdown")
+	flag.IntVar(&defaultLimit, "limit", 10, "Number of results to return when a query doesn't specify a limit")
+	flag.IntVar(&maxLimit, "max-limit", 100, "Maximum number of results a query may ask for")
+	flag.IntVar(&maxOffset, "max-offset", 1000, "Maximum offset a query may page to")
+	flag.IntVar(&maxEdits, "max-edits", 2, "Maximum number of edits a fuzzy query may ask for")
+	flag.IntVar(&caseBoost, "case-boost", 100, "Amount by which a result is ranked higher for matching a query's case exactly, in indexes built with case folding")
+	flag.IntVar(&maxBatch, "max-batch", 100, "Maximum number of queries in a batch")
+	flag.DurationVar(&sessionIdleTimeout, "session-idle-timeout", 5*time.Minute, "Time after which a completion session the client has sent nothing on is closed (0 disables)")
+	wsOrigins := flag.String("ws-origins", "", "Comma-separated origins, such as https://example.com, whose pages may open completion sessions besides the server's own (* allows any)")
+	flag.IntVar(&editPenalty, "edit-penalty", 1000, "Amount by which each edit lowers a fuzzy result's score for ranking")
+	flag.IntVar(&jumpPenalty, "jump-penalty", 100, "Amount by which each jump to a new word lowers an abbreviation result's score for ranking")
+	logFormat := flag.String("log-format", "text", "Format of the application and access logs: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum level of application log messages: debug, info, warn or error")
+	accessLogDest := flag.String("access-log", "-", "File to append the access log to, - for stdout, or empty for none")
 
 	flag.Parse()
 
 	if flag.Arg(0) == "" {
-		fmt.Fprintf(os.Stderr, "usage: %s index_file\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "usage: %s [name=]index_file ...\n", path.Base(os.Args[0]))
 		flag.PrintDefaults()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
-	logger = log.New(os.Stderr, "[prefixserver] ", log.Ldate|log.Ltime|log.Lshortfile|log.LUTC)
-	pool = make(chan *resultsBuffer, *concurrency)
+	var err error
+	if indexes, err = newIndexSet(flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+		os.Exit(exitUsage)
+	}
 
-	for i := 0; i < *concurrency-1; i++ {
-		pool <- newResultsBuffer()
+	if maxLimit < 1 || defaultLimit < 1 || defaultLimit > maxLimit {
+		fmt.Fprintf(os.Stderr, "%s: -limit must be between 1 and -max-limit\n", path.Base(os.Args[0]))
+		os.Exit(exitUsage)
+	}
+	if maxOffset < 0 {
+		fmt.Fprintf(os.Stderr, "%s: -max-offset must not be negative\n", path.Base(os.Args[0]))
+		os.Exit(exitUsage)
 	}
 
-	file, err := os.Open(flag.Arg(0))
-	logger.Printf("Loading index from %s", flag.Arg(0))
+	for _, origin := range strings.Split(*wsOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			sessionOrigins = append(sessionOrigins, origin)
+		}
+	}
 
+	if *logFormat != "text" && *logFormat != "json" {
+		fmt.Fprintf(os.Stderr, "%s: -log-format must be text or json\n", path.Base(os.Args[0]))
+		os.Exit(exitUsage)
+	}
+	minLevel, err := parseLogLevel(*logLevel)
 	if err != nil {
-		logger.Panicf("Loading %s: %s", flag.Arg(0), err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path.Base(os.Args[0]), err)
+		os.Exit(exitUsage)
 	}
 
-	in = index.New()
+	logger = newAppLogger(os.Stderr, *logFormat == "json", minLevel)
+	if accessLog, err = newAccessLogger(*accessLogDest, *logFormat == "json"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: opening access log: %s\n", path.Base(os.Args[0]), err)
+		os.Exit(exitIO)
+	}
 
-	dec := gob.NewDecoder(file)
-	err = dec.Decode(in)
-	if err != nil {
-		logger.Panicf("Decoding %s: %s", flag.Arg(0), err)
+	pool = make(chan *resultsBuffer, *concurrency)
+
+	for i := 0; i < *concurrency-1; i++ {
+		pool <- newResultsBuffer(maxLimit)
 	}
-	logger.Printf("Index loaded.")
+
+	for _, f := range indexes.files {
+		if err := f.Reload(); err != nil {
+			logger.Errorf("Loading index %s: %s", f.name, err)
+			if _, ok := err.(*index.FormatError); ok {
+				os.Exit(exitFormat)
+			}
+			os.Exit(exitIO)
+		}
+		if *watch > 0 {
+			go f.watch(*watch)
+		}
+	}
+
+	go indexes.reloadOnSignal()
+
+	// servers are shut down together when the process is asked to stop
+	servers := []*http.Server{}
 
 	if *profile {
 		profileMux := http.NewServeMux()
@@ -84,89 +195,205 @@ func main() {
 		profileMux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 		profileMux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 		profileMux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
-		profileServer := http.Server{
+		profileServer := &http.Server{
 			Addr:     *profileAddr,
 			Handler:  profileMux,
-			ErrorLog: logger,
+			ErrorLog: logger.std(),
 		}
+		servers = append(servers, profileServer)
 		go func() {
 			logger.Printf("pprof available at %s", *profileAddr)
-			log.Fatal(profileServer.ListenAndServe())
+			if err := profileServer.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Errorf("pprof server: %s", err)
+				os.Exit(exitFailure)
+			}
+		}()
+	}
+
+	if *admin {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/reload", http.HandlerFunc(indexes.handleReload))
+		adminServer := &http.Server{
+			Addr:     *adminAddr,
+			Handler:  adminMux,
+			ErrorLog: logger.std(),
+		}
+		servers = append(servers, adminServer)
+		go func() {
+			logger.Printf("Admin server available at %s", *adminAddr)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Errorf("Admin server: %s", err)
+				os.Exit(exitFailure)
+			}
 		}()
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", http.HandlerFunc(handleHTTP))
+	mux.Handle("/v1/complete", http.HandlerFunc(indexes.handleComplete))
+	mux.Handle("/v1/complete/batch", http.HandlerFunc(indexes.handleBatch))
+	mux.Handle("/v1/complete/session", http.HandlerFunc(indexes.handleSession))
+	mux.Handle("/v1/indexes", http.HandlerFunc(indexes.handleList))
+	mux.Handle("/v1/indexes/", http.HandlerFunc(indexes.handleIndex))
+	mux.Handle("/metrics", http.HandlerFunc(indexes.handleMetrics))
+	mux.Handle("/healthz", http.HandlerFunc(handleHealth))
+	mux.Handle("/readyz", http.HandlerFunc(indexes.handleReady))
+	mux.Handle("/v1/info", http.HandlerFunc(indexes.handleInfo))
 
-	srv := http.Server{
+	srv := &http.Server{
 		Addr:     *addr,
-		ErrorLog: logger,
-		Handler:  mux,
+		ErrorLog: logger.std(),
+		Handler:  instrument(mux),
 	}
+	// sessions' connections are hijacked, so Shutdown leaves closing them to us
+	srv.RegisterOnShutdown(closeWebsockets)
+	servers = append(servers, srv)
 
-	if *tlsCertFile != "" && *tlsKeyFile != "" {
-		logger.Printf("Server listening at https://%s", *addr)
-		log.Fatal(srv.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile))
-	} else {
-		logger.Printf("Server listening at http://%s", *addr)
-		log.Fatal(srv.ListenAndServe())
+	if *grpcAddr != "" {
+		// gRPC needs HTTP/2, which clients speak without TLS unless it's configured
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		grpcServer := &http.Server{
+			Addr:      *grpcAddr,
+			Handler:   instrument(http.HandlerFunc(indexes.handleGRPC)),
+			ErrorLog:  logger.std(),
+			Protocols: protocols,
+		}
+		servers = append(servers, grpcServer)
+		go func() {
+			var err error
+			if *tlsCertFile != "" && *tlsKeyFile != "" {
+				logger.Printf("gRPC server listening at %s with TLS", *grpcAddr)
+				err = grpcServer.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+			} else {
+				logger.Printf("gRPC server listening at %s", *grpcAddr)
+				err = grpcServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				logger.Errorf("gRPC server: %s", err)
+				os.Exit(exitFailure)
+			}
+		}()
 	}
 
+	setReady(true)
+	go func() {
+		var err error
+		if *tlsCertFile != "" && *tlsKeyFile != "" {
+			logger.Printf("Server listening at https://%s", *addr)
+			err = srv.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+		} else {
+			logger.Printf("Server listening at http://%s", *addr)
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			logger.Errorf("Server: %s", err)
+			os.Exit(exitFailure)
+		}
+	}()
+
+	waitForShutdown(servers, *shutdownDelay, *drainTimeout)
+
 }
 
+// handleHTTP serves the legacy /{prefix} route, which queries the default index
+// and answers with a bare array of results, as it did before the versioned routes existed.
 func handleHTTP(w http.ResponseWriter, r *http.Request) {
 
-	logger.Printf("(%s) %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+	// the prefix is the last segment of the path, ignoring trailing slashes as path.Base does,
+	// and unescaped so that it can contain a slash as %2F
+	escaped := strings.TrimRight(r.URL.EscapedPath(), "/")
+	prefix, err := url.PathUnescape(escaped[strings.LastIndex(escaped, "/")+1:])
+	if err == nil && prefix == "" {
+		err = errors.New("a prefix must be given, as in /foo")
+	}
+	if err != nil {
+		logger.Debugf("(%s) %d (%s)", r.RemoteAddr, http.StatusBadRequest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handleQuery(w, r, indexes.Default(), prefix, true)
+
+}
+
+// handleQuery answers a query for prefix against the index in f, with the rest of the query given by URL parameters.
+// legacy queries are answered in the shape of the legacy route.
+func handleQuery(w http.ResponseWriter, r *http.Request, f *indexFile, prefix string, legacy bool) {
 
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		logger.Debugf("(%s) %d (client method: %s)", r.RemoteAddr, http.StatusMethodNotAllowed, r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := &query{Prefix: prefix, legacy: legacy}
+	err := q.parseParams(r)
+	if err == nil {
+		err = q.check()
+	}
+	if err != nil {
+		logger.Debugf("(%s) %d (%s)", r.RemoteAddr, http.StatusBadRequest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	serveQuery(w, r, f, q)
+
+}
+
+// serveQuery answers q, which must have been checked, against the index in f.
+func serveQuery(w http.ResponseWriter, r *http.Request, f *indexFile, q *query) {
+
+	// make sure everything is copacetic with content type
+	mediaType := negotiate(r.Header.Get("Accept"), resultTypes)
+	if mediaType == "" {
+		logger.Debugf("(%s) %d (client Accept: %s)", r.RemoteAddr, http.StatusNotAcceptable, r.Header.Get("Accept"))
+		http.Error(w, "results are available as "+strings.Join(resultTypes, ", "), http.StatusNotAcceptable)
+		return
+	}
+
+	waitStart := time.Now()
 	resultsBuffer := <-pool
+	poolWaitSeconds.observeSince(waitStart)
 	defer func() {
 		pool <- resultsBuffer
 	}()
-	// make sure everything is copacetic with content type
-	accepts := strings.Split(r.Header.Get("Accept"), ",")
-	accepted := accepts == nil
-
-	if !accepted {
-		for i := range accepts {
-			if strings.HasPrefix(accepts[i], "*/*") || accepts[i] == "application/json" {
-				accepted = true
-				break
-			}
-		}
-	}
 
-	if !accepted {
-		w.Header().Set("Accept", "application/json")
-		logger.Printf("(%s) %d (client Accept: %s)", r.RemoteAddr, http.StatusNotAcceptable, r.Header.Get("Accept"))
-		w.WriteHeader(http.StatusNotAcceptable)
-		return
-	} else if r.Method != http.MethodGet {
-		w.Header().Set("Allow", http.MethodGet)
-		logger.Printf("(%s) %d (client method: %s)", r.RemoteAddr, http.StatusMethodNotAllowed, r.Method)
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+	// hold on to this index for the whole request, even if a reload swaps in another.
+	// Results from a memory-mapped index point into its mapping, so it mustn't be
+	// released until we're done with them.
+	in := f.Index()
+	defer runtime.KeepAlive(in)
+
+	resp := q.run(in, resultsBuffer)
+	logger.Debugf("(%s) %s: %d", r.RemoteAddr, q.Prefix, len(resp.Results))
+
+	status := http.StatusOK
+	if len(resp.Results) == 0 {
+		status = http.StatusNotFound
 	}
 
-	prefix := path.Base(r.URL.Path)
+	writeResponse(w, r, &resultsBuffer.buf, status, mediaType, &resp, q.legacy)
 
-	count := in.Find([]byte(prefix), resultsBuffer.values, resultsBuffer.scores)
-	logger.Printf("(%s) %s: %d", r.RemoteAddr, prefix, count)
+}
 
-	if count == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`[]`))
-		return
-	} else {
+// intParam parses the named query parameter as an integer no smaller than min.
+// If the parameter is absent it returns def.
+func intParam(r *http.Request, name string, def int, min int) (int, error) {
 
-		for i := 0; i < count; i++ {
-			resultsBuffer.results[i].Name = string(resultsBuffer.values[i])
-			resultsBuffer.results[i].Score = resultsBuffer.scores[i]
-		}
-		enc := json.NewEncoder(w)
-		if err := enc.Encode(resultsBuffer.results[0:count]); err != nil {
-			logger.Printf("While sending results for query %s: %s", prefix, err)
-		}
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return def, nil
+	}
 
+	n, err := strconv.Atoi(param)
+	if err != nil || n < min {
+		return 0, fmt.Errorf("%s must be an integer no smaller than %d", name, min)
 	}
 
+	return n, nil
+
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	index "github.com/goldibex/prefixserver/index"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is an entry in the indexes served by startTestServer.
+type testEntry struct {
+	name    string
+	score   int
+	payload *index.Payload
+}
+
+var testEntries = []testEntry{
+	{"foo_bar", 10, &index.Payload{Type: "function", Class: "Foo"}},
+	{"foo_baz", 5, &index.Payload{Type: "variable", Class: "Foo"}},
+	{"foo_qux", 3, nil},
+	{"food", 2, nil},
+	{"fool", 1, nil},
+	{"getUserName", 7, nil},
+}
+
+// startTestServer sets up the server's globals as main would, serving an index named test of testEntries
+// and another named other, and returns a function that removes the index files.
+func startTestServer(t *testing.T) func() {
+
+	dir, err := ioutil.TempDir("", "prefixserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{}
+	for _, name := range []string{"test", "other"} {
+
+		in := index.New()
+		for _, e := range testEntries {
+			var payload []byte
+			if e.payload != nil {
+				if payload, err = e.payload.MarshalBinary(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			in.AddWithPayload([]byte(e.name), []byte(e.name), payload, e.score)
+		}
+		in.Compact()
+
+		buf := bytes.Buffer{}
+		if err := in.WriteWithHeader(&buf, index.Header{}, false); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name+".index")
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, path)
+
+	}
+
+	logger = newAppLogger(ioutil.Discard, false, levelError)
+	defaultLimit, maxLimit, maxOffset = 10, 100, 1000
+	maxEdits, editPenalty, jumpPenalty, caseBoost = 2, 1000, 100, 100
+	maxBatch = 3
+
+	if indexes, err = newIndexSet(args); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range indexes.files {
+		if err := f.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool = make(chan *resultsBuffer, 2)
+	for i := 0; i < 2; i++ {
+		pool <- newResultsBuffer(maxLimit)
+	}
+
+	return func() { os.RemoveAll(dir) }
+
+}
+
+// serve makes a request to handler and returns the response.
+func serve(handler http.HandlerFunc, method, target string, body string) *httptest.ResponseRecorder {
+	return serveWith(handler, method, target, body, "")
+}
+
+// serveWith makes a request to handler, accepting the media types in accept, and returns the response.
+func serveWith(handler http.HandlerFunc, method, target string, body string, accept string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	handler(w, r)
+	return w
+}
+
+func TestLegacyRoute(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	w := serve(handleHTTP, http.MethodGet, "/foo?limit=2&offset=1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// the legacy route answers with a bare array of names and scores, and says whether there are more in a header
+	expected := `[{"name":"foo_baz","score":5},{"name":"foo_qux","score":3}]` + "\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, w.Body)
+	}
+	if more := w.Header().Get("X-More-Results"); more != "true" {
+		t.Errorf("expected X-More-Results true, got %q", more)
+	}
+
+	w = serve(handleHTTP, http.MethodGet, "/nothing", "")
+	if w.Code != http.StatusNotFound || w.Body.String() != "[]\n" {
+		t.Errorf("expected a 404 with an empty array, got %d: %s", w.Code, w.Body)
+	}
+
+	// the versioned routes answer with the envelope
+	w = serve(indexes.handleIndex, http.MethodGet, "/v1/indexes/test/complete/foo?limit=1", "")
+	resp := response{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %s: %s", w.Body, err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Name != "foo_bar" || resp.Results[0].Key != "foo_bar" || !resp.More {
+		t.Errorf("expected foo_bar with more to come, got %s", w.Body)
+	}
+
+}
+
+func TestMaxOffset(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+	}{
+		{handleHTTP, http.MethodGet, "/foo?offset=1000", "", http.StatusNotFound},
+		{handleHTTP, http.MethodGet, "/foo?offset=1001", "", http.StatusBadRequest},
+		{indexes.handleComplete, http.MethodGet, "/v1/complete?q=foo&offset=1001", "", http.StatusBadRequest},
+		{indexes.handleComplete, http.MethodPost, "/v1/complete", `{"prefix":"foo","offset":1001}`, http.StatusBadRequest},
+		{indexes.handleComplete, http.MethodPost, "/v1/complete", `{"prefix":"foo","offset":2}`, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		if w := serve(c.handler, c.method, c.target, c.body); w.Code != c.status {
+			t.Errorf("%s %s %s: expected status %d, got %d: %s", c.method, c.target, c.body, c.status, w.Code, w.Body)
+		}
+	}
+
+}
+
+func TestLegacyRoutePrefix(t *testing.T) {
+
+	defer startTestServer(t)()
+
+	cases := []struct {
+		target string
+		status int
+		first  string
+	}{
+		{"/foo", http.StatusOK, "foo_bar"},
+		{"/foo/", http.StatusOK, "foo_bar"},
+		{"/foo//", http.StatusOK, "foo_bar"},
+		{"/any/thing/foo_q", http.StatusOK, "foo_qux"},
+		{"/foo_q%2F", http.StatusNotFound, ""},
+		{"/", http.StatusBadRequest, ""},
+		{"//", http.StatusBadRequest, ""},
+	}
+
+	for _, c := range cases {
+
+		w := serve(handleHTTP, http.MethodGet, c.target, "")
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.target, c.status, w.Code, w.Body)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		results := []legacyResult{}
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: decoding %s: %s", c.target, w.Body, err)
+		}
+		if len(results) == 0 || results[0].Name != c.first {
+			t.Errorf("%s: expected %s first, got %s", c.target, c.first, w.Body)
+		}
+
+	}
+
+}
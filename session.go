@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	index "github.com/goldibex/prefixserver/index"
+	"io"
+	"net/http"
+)
+
+// sessionRequest is a query sent over a session, with an id to match it up with its answer.
+type sessionRequest struct {
+	query
+	ID uint64 `json:"id"`
+
+	// err is why the request couldn't be decoded
+	err error
+}
+
+type sessionResult struct {
+	ID uint64 `json:"id"`
+	*response
+	Error string `json:"error,omitempty"`
+}
+
+// sessionCursor is a cursor into the version of an index that it was made for.
+type sessionCursor struct {
+	in     index.Searcher
+	cursor *index.Cursor
+}
+
+// handleSession serves completion sessions at /v1/complete/session, over WebSocket.
+// The client sends queries as the prefix changes, and each session keeps a cursor into the index
+// so that a prefix extended or shortened by a keystroke needn't be searched for from scratch.
+// As with the gRPC stream, a query superseded before it's answered is dropped.
+func (s *indexSet) handleSession(w http.ResponseWriter, r *http.Request) {
+
+	ws := upgradeWebsocket(w, r, sessionIdleTimeout, sessionOrigins)
+	if ws == nil {
+		return
+	}
+
+	pending := make(chan *sessionRequest, 1)
+	var readErr error
+
+	go func() {
+
+		defer close(pending)
+
+		for {
+
+			msg, err := ws.readMessage(maxQueryBody)
+			if err != nil {
+				readErr = err
+				return
+			}
+
+			req := &sessionRequest{}
+			dec := json.NewDecoder(bytes.NewReader(msg))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(req); err != nil {
+				req.err = fmt.Errorf("bad query: %s", err)
+			}
+
+			select {
+			case <-pending:
+			default:
+			}
+			pending <- req
+
+		}
+
+	}()
+
+	// each index the session queries gets its own cursor, which is replaced when the index is reloaded
+	cursors := map[*indexFile]*sessionCursor{}
+	var writeErr error
+
+	for req := range pending {
+
+		res := s.sessionQuery(req, cursors)
+		if len(pending) > 0 {
+			// already stale
+			continue
+		}
+
+		msg, _ := json.Marshal(&res)
+		if writeErr = ws.writeMessage(msg); writeErr != nil {
+			break
+		}
+
+	}
+
+	if writeErr != nil {
+		ws.close(writeErr)
+		// wait for the reader to notice
+		for range pending {
+		}
+		return
+	}
+
+	if readErr != io.EOF {
+		logger.Debugf("(%s) Session closed: %s", r.RemoteAddr, readErr)
+	}
+	ws.close(readErr)
+
+}
+
+// sessionQuery answers req, using and updating the session's cursors.
+func (s *indexSet) sessionQuery(req *sessionRequest, cursors map[*indexFile]*sessionCursor) sessionResult {
+
+	res := sessionResult{ID: req.ID}
+
+	err := req.err
+	if err == nil {
+		err = req.check()
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	f := s.Default()
+	if req.Index != "" {
+		var ok bool
+		if f, ok = s.byName[req.Index]; !ok {
+			res.Error = fmt.Sprintf("no index named %s", req.Index)
+			return res
+		}
+	}
+
+	c := cursors[f]
+	if in := f.Index(); c == nil || c.in != in {
+		c = &sessionCursor{in: in, cursor: in.Cursor()}
+		cursors[f] = c
+	}
+
+	res.response = runPooled(&req.query, c.cursor)
+	return res
+
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ready is 1 while the server is willing to take new queries, as reported by /readyz.
+var ready int32
+
+func setReady(r bool) {
+	if r {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+// waitForShutdown blocks until the process receives SIGINT or SIGTERM, and then shuts down servers gracefully.
+// It first fails readiness checks for delay, to give load balancers time to notice, or until a second signal,
+// and then stops the servers accepting connections and waits up to drainTimeout for requests in flight to finish.
+// Any requests still running after that have their connections closed.
+func waitForShutdown(servers []*http.Server, delay time.Duration, drainTimeout time.Duration) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	shutdown(signals, servers, delay, drainTimeout)
+
+}
+
+// shutdown does the work of waitForShutdown, taking signals from the given channel.
+func shutdown(signals <-chan os.Signal, servers []*http.Server, delay time.Duration, drainTimeout time.Duration) {
+
+	sig := <-signals
+
+	logger.Printf("Received %s, shutting down", sig)
+	setReady(false)
+
+	if delay > 0 {
+		logger.Printf("Failing readiness checks for %s before draining", delay)
+		select {
+		case <-time.After(delay):
+		case sig := <-signals:
+			logger.Printf("Received %s, draining now", sig)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Warnf("Draining connections to %s: %s (closing them)", srv.Addr, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	logger.Printf("Shut down.")
+
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startShutdownServer serves handler on a local port, and returns the server and its URL.
+func startShutdownServer(t *testing.T, handler http.Handler) (*http.Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: handler}
+	go srv.Serve(ln)
+	return srv, "http://" + ln.Addr().String()
+}
+
+// waitUntil polls cond until it holds, failing the test if it doesn't within a few seconds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+
+	defer startTestServer(t)()
+	setReady(true)
+	defer setReady(true)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", indexes.handleReady)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	srv, url := startShutdownServer(t, mux)
+
+	// a request is in flight when the signal arrives
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		slow <- err
+	}()
+	<-started
+
+	signals := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	go func() {
+		shutdown(signals, []*http.Server{srv}, time.Minute, time.Minute)
+		close(done)
+	}()
+	signals <- syscall.SIGTERM
+
+	// readiness checks fail during the delay, but requests are still served
+	waitUntil(t, "readiness checks fail", func() bool {
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			t.Fatalf("expected requests to be served during the delay, got %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	})
+
+	// a second signal cuts the delay short, and draining waits for the request in flight
+	signals <- syscall.SIGINT
+	waitUntil(t, "new connections are refused", func() bool {
+		resp, err := http.Get(url + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err != nil
+	})
+	select {
+	case <-done:
+		t.Fatalf("expected shutdown to wait for the request in flight")
+	default:
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("expected the request in flight to finish, got %s", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected shutdown to finish once the request in flight did")
+	}
+
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+
+	defer startTestServer(t)()
+	defer setReady(true)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	srv, url := startShutdownServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	stuck := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		stuck <- err
+	}()
+	<-started
+
+	// a request still running after the drain timeout has its connection closed
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	begun := time.Now()
+	shutdown(signals, []*http.Server{srv}, 0, 50*time.Millisecond)
+	if elapsed := time.Since(begun); elapsed > 5*time.Second {
+		t.Errorf("expected shutdown to give up after the drain timeout, took %s", elapsed)
+	}
+
+	select {
+	case err := <-stuck:
+		if err == nil {
+			t.Errorf("expected the stuck request's connection to be closed, got a response")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the stuck request's connection to be closed")
+	}
+
+}
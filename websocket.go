@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Just enough of the WebSocket protocol, RFC 6455, for sessions to exchange text messages.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsWriteTimeout bounds how long a frame may take to write, so that a client that stops reading can't hold up its session.
+const wsWriteTimeout = 10 * time.Second
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket close codes
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsInvalidData     = 1007
+	wsMessageTooBig   = 1009
+)
+
+// wsError is an error that closes a WebSocket connection with the given code.
+type wsError struct {
+	code int
+	msg  string
+}
+
+func (e *wsError) Error() string {
+	return e.msg
+}
+
+// wsConn is the server's end of a WebSocket connection.
+// Messages may be written to it concurrently, but only one goroutine may read from it.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// idleTimeout, if positive, is how long the client may go without sending a frame before it's disconnected
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closed bool
+}
+
+// websockets tracks the open WebSocket connections, which http.Server.Shutdown doesn't once they're hijacked.
+var websockets = struct {
+	sync.Mutex
+	conns map[*wsConn]bool
+}{conns: map[*wsConn]bool{}}
+
+// closeWebsockets closes every open WebSocket connection with Going Away, for the server to call as it shuts down.
+func closeWebsockets() {
+
+	websockets.Lock()
+	conns := make([]*wsConn, 0, len(websockets.conns))
+	for c := range websockets.conns {
+		conns = append(conns, c)
+	}
+	websockets.Unlock()
+
+	for _, c := range conns {
+		c.close(&wsError{wsGoingAway, "server shutting down"})
+	}
+
+}
+
+// upgradeWebsocket turns the request r into a WebSocket connection, which disconnects the client
+// if it's idle for longer than idleTimeout. Browsers may only connect from pages on the server's own host or one of origins;
+// see originAllowed. If r isn't a valid opening handshake it responds with an error, and returns nil.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request, idleTimeout time.Duration, origins []string) *wsConn {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "this endpoint needs a WebSocket connection", http.StatusUpgradeRequired)
+		return nil
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil
+	}
+	if !originAllowed(r, origins) {
+		http.Error(w, fmt.Sprintf("origin %s may not open a WebSocket connection", r.Header.Get("Origin")), http.StatusForbidden)
+		return nil
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Warnf("Upgrading to WebSocket: %s", err)
+		http.Error(w, "can't upgrade this connection to WebSocket", http.StatusInternalServerError)
+		return nil
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil
+	}
+
+	c := &wsConn{conn: conn, r: rw.Reader, w: rw.Writer, idleTimeout: idleTimeout}
+	websockets.Lock()
+	websockets.conns[c] = true
+	websockets.Unlock()
+
+	return c
+
+}
+
+// originAllowed reports whether the page r comes from may open a WebSocket connection. Browsers send an Origin
+// with every handshake, and other clients needn't, so one without is allowed. Otherwise the origin must be on the host
+// r was sent to, or be one of origins, which may be * to allow any.
+func originAllowed(r *http.Request, origins []string) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+
+}
+
+// headerHasToken reports whether the comma-separated list in header name contains token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage reads the next text message, of up to maxLen bytes, answering pings along the way.
+// It returns io.EOF once the client closes the connection, and a *wsError if the client breaks the protocol
+// or is idle for too long.
+func (c *wsConn) readMessage(maxLen int) ([]byte, error) {
+
+	var msg []byte
+	started := false
+
+	for {
+
+		if c.idleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+
+		var head [2]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return nil, readError(err)
+		}
+
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+		if head[0]&0x70 != 0 {
+			return nil, &wsError{wsProtocolError, "reserved bits set"}
+		}
+		if head[1]&0x80 == 0 {
+			return nil, &wsError{wsProtocolError, "client frames must be masked"}
+		}
+
+		length := uint64(head[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, readError(err)
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, readError(err)
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+
+		control := opcode&0x8 != 0
+		if control && (length > 125 || !fin) {
+			return nil, &wsError{wsProtocolError, "malformed control frame"}
+		}
+		if !control && uint64(len(msg))+length > uint64(maxLen) {
+			return nil, &wsError{wsMessageTooBig, fmt.Sprintf("messages may be at most %d bytes", maxLen)}
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return nil, readError(err)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, readError(err)
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// echo the close, which completes the closing handshake
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText:
+			if started {
+				return nil, &wsError{wsProtocolError, "new message before the last was finished"}
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, &wsError{wsProtocolError, "continuation without a message"}
+			}
+		case wsBinary:
+			return nil, &wsError{wsUnsupportedData, "only text messages are supported"}
+		default:
+			return nil, &wsError{wsProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+		}
+
+		msg = append(msg, payload...)
+		if fin {
+			// a message may be split mid-character across frames, so it's only checked once it's whole
+			if !utf8.Valid(msg) {
+				return nil, &wsError{wsInvalidData, "text messages must be UTF-8"}
+			}
+			return msg, nil
+		}
+
+	}
+
+}
+
+// readError turns an error reading a frame into the one the connection is closed with.
+func readError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &wsError{wsGoingAway, "idle for too long"}
+	}
+	return err
+}
+
+// writeMessage sends msg as a text message.
+func (c *wsConn) writeMessage(msg []byte) error {
+	return c.writeFrame(wsText, msg)
+}
+
+// writeFrame sends a single, unfragmented frame, which the server doesn't mask.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+
+	head := make([]byte, 2, 10)
+	head[0] = 0x80 | opcode
+	switch {
+	case len(payload) < 126:
+		head[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	c.w.Write(head)
+	c.w.Write(payload)
+	return c.w.Flush()
+
+}
+
+// close closes the connection, first telling the client why if err is a *wsError.
+// Only the first call has any effect, so a connection closed as the server shuts down
+// can be closed again by its session.
+func (c *wsConn) close(err error) {
+
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+
+	websockets.Lock()
+	delete(websockets.conns, c)
+	websockets.Unlock()
+
+	code, reason := wsNormalClosure, ""
+	if wsErr, ok := err.(*wsError); ok {
+		code, reason = wsErr.code, wsErr.msg
+	}
+
+	if err != io.EOF {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		// the reason must fit in a control frame
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		c.writeFrame(wsClose, append(payload, reason...))
+	}
+
+	c.conn.Close()
+
+}
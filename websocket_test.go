@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderHasToken(t *testing.T) {
+
+	cases := []struct {
+		values   []string
+		expected bool
+	}{
+		{[]string{"Upgrade"}, true},
+		{[]string{"upgrade"}, true},
+		{[]string{"keep-alive, Upgrade"}, true},
+		{[]string{"keep-alive", " UPGRADE "}, true},
+		{[]string{"keep-alive"}, false},
+		{[]string{"upgrader"}, false},
+		{[]string{"Upgrade-Insecure"}, false},
+		{nil, false},
+	}
+
+	for _, c := range cases {
+		header := http.Header{}
+		for _, value := range c.values {
+			header.Add("Connection", value)
+		}
+		if got := headerHasToken(header, "Connection", "upgrade"); got != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.values, c.expected, got)
+		}
+	}
+
+}
+
+// wsClient is the client's end of a WebSocket connection to a test server.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialWebsocket opens a WebSocket connection to the root of srv.
+func dialWebsocket(t *testing.T, srv *httptest.Server) *wsClient {
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no test should take long enough to hit this
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the key and the accept value it calls for are the example in RFC 6455
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", srv.Listener.Addr())
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+		!headerHasToken(resp.Header, "Upgrade", "websocket") || !headerHasToken(resp.Header, "Connection", "upgrade") {
+		t.Fatalf("expected the handshake to be accepted, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	return &wsClient{conn: conn, r: r}
+
+}
+
+// wsFrame builds a client frame, masked with mask unless it's nil.
+func wsFrame(fin bool, opcode byte, payload string, mask []byte) []byte {
+
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+	if mask != nil {
+		frame[1] = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame[1] |= byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] |= 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] |= 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		if mask != nil {
+			frame = append(frame, payload[i]^mask[i%4])
+		} else {
+			frame = append(frame, payload[i])
+		}
+	}
+	return frame
+
+}
+
+// readFrame reads a frame from the server and describes it as its opcode and payload, or as the code and reason
+// of a close frame. It returns the empty string once the server closes the connection.
+func (c *wsClient) readFrame(t *testing.T) string {
+
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err == io.EOF {
+		return ""
+	} else if err != nil {
+		t.Fatalf("reading a frame: %s", err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		t.Fatalf("expected an unfragmented and unmasked frame, got %x", head)
+	}
+
+	length := int(head[1])
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatalf("reading a frame: %s", err)
+	}
+
+	switch head[0] & 0x0f {
+	case wsText:
+		return "text " + string(payload)
+	case wsPong:
+		return "pong " + string(payload)
+	case wsClose:
+		if len(payload) < 2 {
+			return "close"
+		}
+		return fmt.Sprintf("close %d %s", binary.BigEndian.Uint16(payload), payload[2:])
+	}
+	return fmt.Sprintf("opcode %d", head[0]&0x0f)
+
+}
+
+// echoWebsocket upgrades each request to a WebSocket connection, and echoes each message of up to 16 bytes sent on it.
+func echoWebsocket(idleTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws := upgradeWebsocket(w, r, idleTimeout, nil)
+		if ws == nil {
+			return
+		}
+		for {
+			msg, err := ws.readMessage(16)
+			if err != nil {
+				ws.close(err)
+				return
+			}
+			ws.writeMessage(msg)
+		}
+	}
+}
+
+func TestWebsocketFrames(t *testing.T) {
+
+	logger = newAppLogger(ioutil.Discard, false, levelError)
+	srv := httptest.NewServer(echoWebsocket(0))
+	defer srv.Close()
+
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+
+	cases := []struct {
+		name     string
+		frames   [][]byte
+		expected []string
+	}{
+		{"masked", [][]byte{wsFrame(true, wsText, "hello", mask), wsFrame(true, wsText, "again", []byte{0, 0, 0, 0})},
+			[]string{"text hello", "text again"}},
+		{"unmasked", [][]byte{wsFrame(true, wsText, "hello", nil)},
+			[]string{"close 1002 client frames must be masked"}},
+		// control frames may come between the fragments of a message
+		{"fragmented", [][]byte{wsFrame(false, wsText, "hel", mask), wsFrame(true, wsPing, "p", mask), wsFrame(false, wsContinuation, "l", mask), wsFrame(true, wsContinuation, "o", mask)},
+			[]string{"pong p", "text hello"}},
+		{"continuation without a message", [][]byte{wsFrame(true, wsContinuation, "hello", mask)},
+			[]string{"close 1002 continuation without a message"}},
+		{"unfinished message", [][]byte{wsFrame(false, wsText, "hel", mask), wsFrame(true, wsText, "lo", mask)},
+			[]string{"close 1002 new message before the last was finished"}},
+		{"largest", [][]byte{wsFrame(false, wsText, "0123456789", mask), wsFrame(true, wsContinuation, "abcdef", mask)},
+			[]string{"text 0123456789abcdef"}},
+		{"oversized", [][]byte{wsFrame(true, wsText, "0123456789abcdefg", mask)},
+			[]string{"close 1009 messages may be at most 16 bytes"}},
+		{"oversized fragments", [][]byte{wsFrame(false, wsText, "0123456789", mask), wsFrame(true, wsContinuation, "abcdefg", mask)},
+			[]string{"close 1009 messages may be at most 16 bytes"}},
+		// a frame that's too long is refused from its header, without waiting for its payload
+		{"oversized 16-bit length", [][]byte{wsFrame(true, wsText, strings.Repeat("x", 200), mask)[:8]},
+			[]string{"close 1009 messages may be at most 16 bytes"}},
+		{"oversized 64-bit length", [][]byte{{0x81, 0xff, 0, 0, 1, 0, 0, 0, 0, 0}},
+			[]string{"close 1009 messages may be at most 16 bytes"}},
+		// a character split across fragments is only checked once the message is whole
+		{"split character", [][]byte{wsFrame(false, wsText, "caf\xc3", mask), wsFrame(true, wsContinuation, "\xa9", mask)},
+			[]string{"text caf\xc3\xa9"}},
+		{"invalid UTF-8", [][]byte{wsFrame(true, wsText, "caf\xc3", mask)},
+			[]string{"close 1007 text messages must be UTF-8"}},
+		{"invalid UTF-8 fragments", [][]byte{wsFrame(false, wsText, "caf", mask), wsFrame(true, wsContinuation, "\xff", mask)},
+			[]string{"close 1007 text messages must be UTF-8"}},
+		{"binary", [][]byte{wsFrame(true, wsBinary, "hello", mask)},
+			[]string{"close 1003 only text messages are supported"}},
+		{"long ping", [][]byte{wsFrame(true, wsPing, strings.Repeat("x", 126), mask)},
+			[]string{"close 1002 malformed control frame"}},
+		{"fragmented ping", [][]byte{wsFrame(false, wsPing, "p", mask)},
+			[]string{"close 1002 malformed control frame"}},
+		{"reserved bits", [][]byte{append([]byte{0xc1}, wsFrame(true, wsText, "hello", mask)[1:]...)},
+			[]string{"close 1002 reserved bits set"}},
+		{"unknown opcode", [][]byte{wsFrame(true, 0x3, "hello", mask)},
+			[]string{"close 1002 unknown opcode 3"}},
+		{"ping", [][]byte{wsFrame(true, wsPing, "are you there", mask), wsFrame(true, wsPong, "unasked", mask), wsFrame(true, wsText, "yes", mask)},
+			[]string{"pong are you there", "text yes"}},
+		// the server echoes the client's close to complete the closing handshake
+		{"close", [][]byte{wsFrame(true, wsText, "hello", mask), wsFrame(true, wsClose, "\x03\xe8bye", mask), wsFrame(true, wsText, "ignored", mask)},
+			[]string{"text hello", "close 1000 bye"}},
+	}
+
+	for _, c := range cases {
+
+		client := dialWebsocket(t, srv)
+		for _, frame := range c.frames {
+			client.conn.Write(frame)
+		}
+
+		for _, expected := range c.expected {
+			if got := client.readFrame(t); got != expected {
+				t.Errorf("%s: expected %q, got %q", c.name, expected, got)
+			}
+		}
+		if strings.HasPrefix(c.expected[len(c.expected)-1], "close") {
+			if got := client.readFrame(t); got != "" {
+				t.Errorf("%s: expected the connection to be closed, got %q", c.name, got)
+			}
+		}
+
+		client.conn.Close()
+
+	}
+
+}
+
+func TestWebsocketHandshake(t *testing.T) {
+
+	logger = newAppLogger(ioutil.Discard, false, levelError)
+	handler := echoWebsocket(0)
+
+	cases := []struct {
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{http.MethodPost, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "k"}, http.StatusMethodNotAllowed},
+		{http.MethodGet, map[string]string{"Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "k"}, http.StatusUpgradeRequired},
+		{http.MethodGet, map[string]string{"Connection": "Upgrade", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "k"}, http.StatusUpgradeRequired},
+		{http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "k"}, http.StatusUpgradeRequired},
+		{http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "k", "Origin": "https://elsewhere.example"}, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "/", nil)
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		handler(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s %v: expected status %d, got %d", c.method, c.headers, c.status, w.Code)
+		}
+	}
+
+	// a valid handshake is checked by dialWebsocket
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	client := dialWebsocket(t, srv)
+	client.conn.Close()
+
+}
+
+func TestOriginAllowed(t *testing.T) {
+
+	cases := []struct {
+		origin   string
+		origins  []string
+		expected bool
+	}{
+		// clients other than browsers needn't say where they're from
+		{"", nil, true},
+		{"https://example.com", nil, true},
+		{"http://EXAMPLE.com", nil, true},
+		{"https://example.com:8443", nil, false},
+		{"https://evil.example", nil, false},
+		{"https://example.com.evil.example", nil, false},
+		{"null", nil, false},
+		{"https://app.example", []string{"https://other.example", "https://app.example"}, true},
+		{"http://app.example", []string{"https://app.example"}, false},
+		{"https://evil.example", []string{"*"}, true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/v1/complete/session", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := originAllowed(r, c.origins); got != c.expected {
+			t.Errorf("%q with %q allowed: expected %v, got %v", c.origin, c.origins, c.expected, got)
+		}
+	}
+
+}
+
+func TestWebsocketIdleTimeout(t *testing.T) {
+
+	logger = newAppLogger(ioutil.Discard, false, levelError)
+	srv := httptest.NewServer(echoWebsocket(100 * time.Millisecond))
+	defer srv.Close()
+
+	client := dialWebsocket(t, srv)
+	defer client.conn.Close()
+	mask := []byte{1, 2, 3, 4}
+
+	// pings keep a session alive as much as messages do
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		client.conn.Write(wsFrame(true, wsPing, "", mask))
+		if got := client.readFrame(t); got != "pong " {
+			t.Fatalf("expected a pong, got %q", got)
+		}
+	}
+
+	if got := client.readFrame(t); got != "close 1001 idle for too long" {
+		t.Errorf("expected the idle session to be closed, got %q", got)
+	}
+
+}
+
+func TestWebsocketShutdown(t *testing.T) {
+
+	defer startTestServer(t)()
+	// the server doesn't wait for the session's handler, which is using the globals, so the test must
+	handled := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		indexes.handleSession(w, r)
+		close(handled)
+	}))
+	srv.Config.RegisterOnShutdown(closeWebsockets)
+	defer srv.Close()
+
+	client := dialWebsocket(t, srv)
+	defer client.conn.Close()
+
+	client.conn.Write(wsFrame(true, wsText, `{"id":1,"prefix":"get","limit":1}`, []byte{1, 2, 3, 4}))
+	if got := client.readFrame(t); !strings.HasPrefix(got, `text {"id":1,"results":[{"name":"getUserName"`) {
+		t.Fatalf("expected an answer, got %q", got)
+	}
+
+	// Shutdown doesn't wait for hijacked connections, but tells their sessions to go away
+	if err := srv.Config.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.readFrame(t); got != "close 1001 server shutting down" {
+		t.Errorf("expected the session to be closed, got %q", got)
+	}
+	if got := client.readFrame(t); got != "" {
+		t.Errorf("expected the connection to be closed, got %q", got)
+	}
+	<-handled
+
+	websockets.Lock()
+	defer websockets.Unlock()
+	if len(websockets.conns) != 0 {
+		t.Errorf("expected no connections to be left open, got %d", len(websockets.conns))
+	}
+
+}